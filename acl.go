@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+)
+
+// remoteIP extracts the client address from a DNS connection's remote
+// address.
+func remoteIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// clientAllowed applies ALLOW_CIDRS and DENY_CIDRS to a client address.
+// With neither set every client is served.
+func (s *Server) clientAllowed(ip net.IP) bool {
+	if len(s.config().DenyCIDRs) > 0 && containsIP(s.config().DenyCIDRs, ip) {
+		return false
+	}
+	return len(s.config().AllowCIDRs) == 0 || containsIP(s.config().AllowCIDRs, ip)
+}
+
+// nameDenied reports whether name matches one of DENY_NAME_REGEX.
+func (s *Server) nameDenied(name string) bool {
+	name = strings.ToLower(name)
+	for _, re := range s.config().DenyNames {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	return ip != nil && slices.ContainsFunc(nets, func(n *net.IPNet) bool { return n.Contains(ip) })
+}
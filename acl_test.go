@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientACL(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		client net.IP
+		served bool
+	}{
+		{"open", nil, net.ParseIP("198.51.100.1"), true},
+		{"allowed", map[string]string{"ALLOW_CIDRS": "10.0.0.0/8"}, net.ParseIP("10.1.2.3"), true},
+		{"not allowed", map[string]string{"ALLOW_CIDRS": "10.0.0.0/8"}, net.ParseIP("198.51.100.1"), false},
+		{"denied", map[string]string{"DENY_CIDRS": "198.51.100.0/24"}, net.ParseIP("198.51.100.1"), false},
+		{"not denied", map[string]string{"DENY_CIDRS": "198.51.100.0/24"}, net.ParseIP("203.0.113.1"), true},
+		{"deny wins", map[string]string{"ALLOW_CIDRS": "10.0.0.0/8", "DENY_CIDRS": "10.0.0.5"}, net.ParseIP("10.0.0.5"), false},
+		{"IPv6 allowed", map[string]string{"ALLOW_CIDRS": "2001:db8::/32"}, net.ParseIP("2001:db8::5"), true},
+		{"IPv6 not allowed", map[string]string{"ALLOW_CIDRS": "10.0.0.0/8"}, net.ParseIP("2001:db8::5"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.env, newIngress("app", "app.example.com"))
+			for _, remote := range []net.Addr{&net.UDPAddr{IP: tt.client, Port: 5353}, &net.TCPAddr{IP: tt.client, Port: 5353}} {
+				req := new(dns.Msg)
+				req.SetQuestion("app.example.com.", dns.TypeA)
+				r := exchange(t, s, req, remote)
+				if served := r.Rcode != dns.RcodeRefused; served != tt.served {
+					t.Errorf("%s: rcode = %s, want served = %t", remote.Network(), dns.RcodeToString[r.Rcode], tt.served)
+				}
+			}
+		})
+	}
+}
+
+func TestDenyNameRegex(t *testing.T) {
+	s := newTestServer(t, map[string]string{"DENY_NAME_REGEX": `(^|\.)internal\.example\.com$,^wpad\.`},
+		newIngress("app", "app.example.com", "db.internal.example.com", "wpad.example.com"))
+	tests := []struct {
+		name  string
+		rcode int
+	}{
+		{"app.example.com", dns.RcodeSuccess},
+		{"db.internal.example.com", dns.RcodeNameError},
+		{"DB.Internal.Example.com", dns.RcodeNameError},
+		{"wpad.example.com", dns.RcodeNameError},
+		{"notinternal.example.com", dns.RcodeNameError},
+	}
+	for _, tt := range tests {
+		r := query(t, s, tt.name, dns.TypeA)
+		if r.Rcode != tt.rcode {
+			t.Errorf("%s: rcode = %s, want %s", tt.name, dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+		}
+	}
+	if !s.nameDenied("db.internal.example.com") || s.nameDenied("app.example.com") {
+		t.Error("nameDenied disagrees with the answers")
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5353}, "10.0.0.5"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::5"), Port: 5353, Zone: "eth0"}, "2001:db8::5"},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 5353}, "::1"},
+		{dohAddr("[2001:db8::5]:44321"), "2001:db8::5"},
+		{dohAddr("10.0.0.5:44321"), "10.0.0.5"},
+		{dohAddr("bogus"), "<nil>"},
+	}
+	for _, tt := range tests {
+		if got := remoteIP(tt.addr).String(); got != tt.want {
+			t.Errorf("remoteIP(%s) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestClientACLIPv6(t *testing.T) {
+	s := newTestServer(t, map[string]string{"ALLOW_CIDRS": "10.0.0.0/8,2001:db8::/32", "DENY_CIDRS": "2001:db8:bad::/48"})
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"2001:db8::5", true},
+		{"2001:db8:bad::5", false},
+		{"2001:db9::5", false},
+		{"::ffff:10.0.0.5", true}, // IPv4-mapped, as from a dual-stack socket
+		{"::1", false},
+	}
+	for _, tt := range tests {
+		if got := s.clientAllowed(net.ParseIP(tt.ip)); got != tt.allowed {
+			t.Errorf("clientAllowed(%s) = %t, want %t", tt.ip, got, tt.allowed)
+		}
+	}
+}
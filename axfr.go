@@ -0,0 +1,109 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+// handleAXFR streams the zone asked for as SOA, one record set per ingress
+// host inside it, and the closing SOA. Transfers are refused unless
+// ALLOW_AXFR is set, the request came over TCP and, when AXFR_ALLOW_CIDRS is
+// set, the client is in one of those networks.
+func (s *Server) handleAXFR(w dns.ResponseWriter, r *dns.Msg) {
+	q := r.Question[0]
+	zone := dns.CanonicalName(q.Name)
+	client := remoteIP(w.RemoteAddr())
+
+	_, isTCP := w.RemoteAddr().(*net.TCPAddr)
+	allowed := s.config().AllowAXFR && isTCP && (len(s.config().AXFRAllowCIDRs) == 0 || containsIP(s.config().AXFRAllowCIDRs, client))
+	if !allowed || !slices.Contains(s.config().Zones, zone) {
+		slog.Info("Refused zone transfer", "zone", zone, "client", client)
+		refuse(w, r)
+		return
+	}
+
+	ingresses, err := s.fetchIngresses(context.Background())
+	if err != nil {
+		slog.Error("Failed to fetch ingresses", "zone", zone, "err", err)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	soa := s.newSOA(zone)
+	records := append([]dns.RR{soa}, s.zoneRecords(ingresses, zone)...)
+	records = append(records, soa)
+	slog.Info("Zone transfer", "zone", zone, "client", client, "records", len(records))
+
+	// Send the records in chunks so no single message exceeds 64KiB.
+	const chunkSize = 256
+	ch := make(chan *dns.Envelope, (len(records)+chunkSize-1)/chunkSize)
+	for start := 0; start < len(records); start += chunkSize {
+		ch <- &dns.Envelope{RR: records[start:min(start+chunkSize, len(records))]}
+	}
+	close(ch)
+	tr := new(dns.Transfer)
+	if err := tr.Out(w, r, ch); err != nil {
+		slog.Warn("Zone transfer failed", "zone", zone, "client", client, "err", err)
+	}
+}
+
+// zoneRecords builds the A, AAAA and CNAME records of every ingress host
+// inside zone, as they would be answered to a query: the addresses of every
+// ingress declaring a host are merged as matchIngress does.
+func (s *Server) zoneRecords(ingresses []*networkingv1.Ingress, zone string) []dns.RR {
+	matches := make(map[string]*ingressMatch)
+	var hosts []string
+	for _, ingress := range ingresses {
+		if !s.matchIngressClass(ingress) || !s.matchIngressAnnotation(ingress) {
+			continue
+		}
+		for _, host := range s.ingressHosts(ingress) {
+			host := canonicalHost(host)
+			if host == "" || !dns.IsSubDomain(zone, host) {
+				continue
+			}
+			match := s.newIngressMatch(ingress, host)
+			if merged, ok := matches[host]; ok {
+				merged.merge(match)
+				continue
+			}
+			matches[host] = &match
+			hosts = append(hosts, host)
+		}
+	}
+
+	var records []dns.RR
+	for _, host := range hosts {
+		match := matches[host]
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			q := dns.Question{Name: host, Qtype: qtype, Qclass: dns.ClassINET}
+			for _, record := range s.ingressRecords(q, *match) {
+				rr, err := dns.NewRR(record)
+				if err != nil {
+					continue
+				}
+				rr.Header().Ttl = match.TTL
+				records = append(records, rr)
+			}
+		}
+	}
+
+	// Sort within a name too, as the addresses come out rotated.
+	slices.SortFunc(records, func(a, b dns.RR) int {
+		return cmp.Or(
+			strings.Compare(a.Header().Name, b.Header().Name),
+			cmp.Compare(a.Header().Rrtype, b.Header().Rrtype),
+			strings.Compare(a.String(), b.String()),
+		)
+	})
+	return dns.Dedup(records, nil)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+// tcpClient is the address of a test client connecting over TCP.
+var tcpClient = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 5353}
+
+func TestAXFR(t *testing.T) {
+	ingresses := []*networkingv1.Ingress{
+		withStatus(newIngress("app", "app.example.com", "www.example.com"), "10.0.0.2", "2001:db8::2"),
+		withStatus(newIngress("app-canary", "app.example.com"), "10.0.0.3"),
+		withStatus(newIngress("lb", "lb.example.com"), "lb.example.net"),
+		newIngress("default-ip", "default.example.com"),
+		newIngress("outside", "app.example.org"),
+	}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		zone    string
+		remote  net.Addr
+		refused bool
+	}{
+		{"allowed", map[string]string{"ALLOW_AXFR": "true"}, "example.com.", tcpClient, false},
+		{"allowed network", map[string]string{"ALLOW_AXFR": "true", "AXFR_ALLOW_CIDRS": "192.0.2.0/24"}, "example.com.", tcpClient, false},
+		{"disabled", nil, "example.com.", tcpClient, true},
+		{"over UDP", map[string]string{"ALLOW_AXFR": "true"}, "example.com.", udpClient, true},
+		{"other network", map[string]string{"ALLOW_AXFR": "true", "AXFR_ALLOW_CIDRS": "198.51.100.0/24"}, "example.com.", tcpClient, true},
+		{"not our zone", map[string]string{"ALLOW_AXFR": "true"}, "example.org.", tcpClient, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"ZONE": "example.com"}
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			s := newTestServer(t, env, ingresses...)
+			req := new(dns.Msg)
+			req.SetAxfr(tt.zone)
+			w := &testWriter{remote: tt.remote}
+			s.handleDNSRequest(w, req)
+
+			if tt.refused {
+				if w.msg == nil || w.msg.Rcode != dns.RcodeRefused {
+					t.Fatalf("reply = %v, want REFUSED", w.msg)
+				}
+				return
+			}
+			var records []dns.RR
+			for _, m := range w.msgs {
+				records = append(records, m.Answer...)
+			}
+			if len(records) < 2 || records[0].Header().Rrtype != dns.TypeSOA || records[len(records)-1].Header().Rrtype != dns.TypeSOA {
+				t.Fatalf("transfer = %v, want records between two SOAs", records)
+			}
+			var got []string
+			for _, rr := range records[1 : len(records)-1] {
+				got = append(got, rr.Header().Name+" "+rdata([]dns.RR{rr})[0])
+			}
+			want := []string{
+				"app.example.com. A 10.0.0.2",
+				"app.example.com. A 10.0.0.3",
+				"app.example.com. AAAA 2001:db8::2",
+				"default.example.com. A 10.0.0.1",
+				"lb.example.com. CNAME lb.example.net.",
+				"www.example.com. A 10.0.0.2",
+				"www.example.com. AAAA 2001:db8::2",
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("transfer = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	rcode int
+	// forwarded marks replies that came from FALLBACK_DNS.
+	forwarded bool
+	answer    []dns.RR
+	ns        []dns.RR
+	stored    time.Time
+	expires   time.Time
+}
+
+// responseCache is a size-bounded LRU of assembled answers. Entries expire
+// with the smallest TTL among their records. Negative answers (NXDOMAIN and
+// NODATA) expire with the SOA minimum from their authority section as in
+// RFC 2308, or after NEGATIVE_TTL when there is none.
+type responseCache struct {
+	mu   sync.Mutex
+	size int
+	// negativeTTL is used for negative answers without an SOA record.
+	negativeTTL uint32
+	order       *list.List
+	items       map[cacheKey]*list.Element
+}
+
+func newResponseCache(size int, negativeTTL uint32) *responseCache {
+	return &responseCache{
+		size:        size,
+		negativeTTL: negativeTTL,
+		order:       list.New(),
+		items:       make(map[cacheKey]*list.Element),
+	}
+}
+
+// flush drops every entry.
+func (c *responseCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	clear(c.items)
+}
+
+// reset drops every entry and applies a new size and negative TTL.
+func (c *responseCache) reset(size int, negativeTTL uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size, c.negativeTTL = size, negativeTTL
+	c.order.Init()
+	clear(c.items)
+}
+
+func newCacheKey(q dns.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype}
+}
+
+// get returns a copy of the cached reply for q, holding the rcode, answer
+// and authority sections, with the TTLs reduced by the time spent in the
+// cache and the owner names matching the query's casing.
+func (c *responseCache) get(q dns.Question) (*dns.Msg, bool) {
+	if c.size <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := newCacheKey(q)
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	m := &dns.Msg{
+		Answer: copyRecords(entry.answer, q.Name, elapsed),
+		Ns:     copyRecords(entry.ns, q.Name, elapsed),
+	}
+	m.Rcode = entry.rcode
+	m.RecursionAvailable = entry.forwarded
+	return m, true
+}
+
+func copyRecords(records []dns.RR, name string, elapsed uint32) []dns.RR {
+	if len(records) == 0 {
+		return nil
+	}
+	copied := make([]dns.RR, len(records))
+	for i, rr := range records {
+		copied[i] = dns.Copy(rr)
+		copied[i].Header().Ttl -= min(elapsed, copied[i].Header().Ttl)
+		if strings.EqualFold(copied[i].Header().Name, name) {
+			copied[i].Header().Name = name
+		}
+	}
+	return copied
+}
+
+// set stores a copy of a positive answer for q, forwarded when it came from
+// upstream. Empty answers and answers with a zero TTL are not cached.
+func (c *responseCache) set(q dns.Question, answer []dns.RR, forwarded bool) {
+	if len(answer) == 0 {
+		return
+	}
+	ttl := answer[0].Header().Ttl
+	for _, rr := range answer {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	c.store(q, &cacheEntry{rcode: dns.RcodeSuccess, forwarded: forwarded, answer: answer}, ttl)
+}
+
+// setNegative stores a copy of an upstream NXDOMAIN or NODATA reply for q
+// with its authority section.
+func (c *responseCache) setNegative(q dns.Question, rcode int, answer, ns []dns.RR) {
+	ttl := c.negativeTTL
+	for _, rr := range ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = min(soa.Hdr.Ttl, soa.Minttl)
+			break
+		}
+	}
+	c.store(q, &cacheEntry{rcode: rcode, forwarded: true, answer: answer, ns: ns}, ttl)
+}
+
+func (c *responseCache) store(q dns.Question, entry *cacheEntry, ttl uint32) {
+	if c.size <= 0 || ttl == 0 {
+		return
+	}
+	entry.answer = copyRecords(entry.answer, q.Name, 0)
+	entry.ns = copyRecords(entry.ns, q.Name, 0)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	key := newCacheKey(q)
+	entry.key, entry.stored = key, now
+	entry.expires = now.Add(time.Duration(ttl) * time.Second)
+	if elem, ok := c.items[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// mustRR parses a record, failing the test if it doesn't parse.
+func mustRR(t testing.TB, record string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(record)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", record, err)
+	}
+	return rr
+}
+
+// expire makes the cached entry for q expire now.
+func expire(c *responseCache, q dns.Question) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[newCacheKey(q)]; ok {
+		elem.Value.(*cacheEntry).expires = time.Now()
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	q := dns.Question{Name: "app.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	answer := []dns.RR{mustRR(t, "app.example.com. 60 IN A 10.0.0.2"), mustRR(t, "app.example.com. 30 IN A 10.0.0.3")}
+
+	c := newResponseCache(2, 30)
+	if _, ok := c.get(q); ok {
+		t.Fatal("hit on an empty cache")
+	}
+
+	c.set(q, answer, true)
+	r, ok := c.get(q)
+	if !ok {
+		t.Fatal("miss after set")
+	}
+	if got, want := rdata(r.Answer), []string{"A 10.0.0.2", "A 10.0.0.3"}; !slices.Equal(got, want) {
+		t.Errorf("answer = %q, want %q", got, want)
+	}
+	if !r.RecursionAvailable {
+		t.Error("forwarded answer served without RA")
+	}
+
+	mixedCase := dns.Question{Name: "App.Example.COM.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if r, ok := c.get(mixedCase); !ok || r.Answer[0].Header().Name != mixedCase.Name {
+		t.Errorf("mixed-case query: hit = %t, answer %v, want a hit owned by %s", ok, r, mixedCase.Name)
+	}
+	answer[0].(*dns.A).A[3] = 99
+	if r, _ := c.get(q); r.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Error("cached answer changed with the records it was stored from")
+	}
+
+	expire(c, q)
+	if _, ok := c.get(q); ok {
+		t.Error("hit after expiry")
+	}
+
+	c.set(q, []dns.RR{mustRR(t, "app.example.com. 0 IN A 10.0.0.2")}, false)
+	if _, ok := c.get(q); ok {
+		t.Error("zero TTL answer was cached")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	c := newResponseCache(2, 30)
+	questions := make([]dns.Question, 3)
+	for i, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		questions[i] = dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	}
+	c.set(questions[0], []dns.RR{mustRR(t, "a.example.com. 60 IN A 10.0.0.1")}, false)
+	c.set(questions[1], []dns.RR{mustRR(t, "b.example.com. 60 IN A 10.0.0.2")}, false)
+	c.get(questions[0]) // a is now the most recently used
+	c.set(questions[2], []dns.RR{mustRR(t, "c.example.com. 60 IN A 10.0.0.3")}, false)
+
+	for i, want := range []bool{true, false, true} {
+		if _, ok := c.get(questions[i]); ok != want {
+			t.Errorf("%s: hit = %t, want %t", questions[i].Name, ok, want)
+		}
+	}
+
+	c.flush()
+	for _, q := range questions {
+		if _, ok := c.get(q); ok {
+			t.Errorf("%s: hit after flush", q.Name)
+		}
+	}
+}
+
+func TestCachedQueries(t *testing.T) {
+	var exchanges atomic.Int64
+	env := fallbackEnv(startUpstream(t, counted(&exchanges, answerWith("A 192.0.2.1"))))
+	env["ZONE"] = "example.com"
+	s := newTestServer(t, env, newIngress("app", "app.example.com"))
+
+	for range 2 {
+		r := query(t, s, "forwarded.example.org", dns.TypeA)
+		if !slices.Equal(rdata(r.Answer), []string{"A 192.0.2.1"}) || !r.RecursionAvailable || r.Authoritative {
+			t.Errorf("forwarded answer = %q, RA %t, AA %t, want [A 192.0.2.1] with RA and without AA", rdata(r.Answer), r.RecursionAvailable, r.Authoritative)
+		}
+	}
+	if n := exchanges.Load(); n != 1 {
+		t.Errorf("upstream got %d queries, want 1 with the second answered from cache", n)
+	}
+
+	for range 2 {
+		r := query(t, s, "app.example.com", dns.TypeA)
+		if !slices.Equal(rdata(r.Answer), []string{"A 10.0.0.1"}) || r.RecursionAvailable || !r.Authoritative {
+			t.Errorf("ingress answer = %q, RA %t, AA %t, want [A 10.0.0.1] with AA and without RA", rdata(r.Answer), r.RecursionAvailable, r.Authoritative)
+		}
+	}
+
+	q := dns.Question{Name: "forwarded.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	expire(s.responses, q)
+	query(t, s, "forwarded.example.org", dns.TypeA)
+	if n := exchanges.Load(); n != 2 {
+		t.Errorf("upstream got %d queries, want 2 after the cached answer expired", n)
+	}
+}
+
+func TestCacheFlushedOnIngressChange(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	s := newInformerServer(t, fallbackEnv(startUpstream(t, answerWith("A 192.0.2.1"))), client)
+
+	if got := rdata(query(t, s, "app.example.com", dns.TypeA).Answer); !slices.Equal(got, []string{"A 192.0.2.1"}) {
+		t.Fatalf("answer before the ingress = %q, want the upstream's", got)
+	}
+	ingress := withStatus(newIngress("app", "app.example.com"), "10.0.0.2")
+	if _, err := client.NetworkingV1().Ingresses("default").Create(context.Background(), ingress, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("creating ingress: %v", err)
+	}
+	waitFor(t, "the cached upstream answer to be dropped", func() bool {
+		return slices.Equal(rdata(query(t, s, "app.example.com", dns.TypeA).Answer), []string{"A 10.0.0.2"})
+	})
+}
+
+// negativeWith is an upstream handler answering every question with rcode
+// and no records, with an SOA in the authority section unless soa is "".
+func negativeWith(rcode int, soa string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		if soa != "" {
+			rr, err := dns.NewRR(soa)
+			if err != nil {
+				panic(err)
+			}
+			m.Ns = []dns.RR{rr}
+		}
+		w.WriteMsg(m)
+	}
+}
+
+const upstreamSOA = "example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 1 3600 600 86400 60"
+
+func TestNegativeCache(t *testing.T) {
+	tests := []struct {
+		name  string
+		rcode int
+		soa   string
+		ttl   time.Duration
+	}{
+		{"NXDOMAIN", dns.RcodeNameError, upstreamSOA, 60 * time.Second},
+		{"NODATA", dns.RcodeSuccess, upstreamSOA, 60 * time.Second},
+		{"NXDOMAIN without SOA", dns.RcodeNameError, "", 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var exchanges atomic.Int64
+			env := fallbackEnv(startUpstream(t, counted(&exchanges, negativeWith(tt.rcode, tt.soa))))
+			env["NEGATIVE_TTL"] = "10"
+			s := newTestServer(t, env)
+
+			for i := range 2 {
+				r := query(t, s, "missing.example.org", dns.TypeA)
+				if r.Rcode != tt.rcode || len(r.Answer) != 0 {
+					t.Errorf("query %d: rcode = %s, answer = %q, want %s without records", i, dns.RcodeToString[r.Rcode], rdata(r.Answer), dns.RcodeToString[tt.rcode])
+				}
+				if wantNs := tt.soa != ""; (len(r.Ns) == 1) != wantNs {
+					t.Errorf("query %d: authority = %v, want the SOA: %t", i, r.Ns, wantNs)
+				}
+			}
+			if n := exchanges.Load(); n != 1 {
+				t.Errorf("upstream got %d queries, want 1 with the second answered from cache", n)
+			}
+
+			q := dns.Question{Name: "missing.example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+			s.responses.mu.Lock()
+			entry := s.responses.items[newCacheKey(q)].Value.(*cacheEntry)
+			s.responses.mu.Unlock()
+			if ttl := entry.expires.Sub(entry.stored); ttl != tt.ttl {
+				t.Errorf("cached for %v, want %v", ttl, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestNegativeCacheSkipsLocalAnswers(t *testing.T) {
+	s := newTestServer(t, map[string]string{"ZONE": "example.com"})
+	query(t, s, "missing.example.org", dns.TypeA)
+	query(t, s, "missing.example.com", dns.TypeA)
+	if n := s.responses.order.Len(); n != 0 {
+		t.Errorf("cache holds %d entries, want our own negative answers left uncached", n)
+	}
+}
+
+func TestNegativeCacheDroppedOnIngressAdd(t *testing.T) {
+	var exchanges atomic.Int64
+	client := fake.NewSimpleClientset()
+	s := newInformerServer(t, fallbackEnv(startUpstream(t, counted(&exchanges, negativeWith(dns.RcodeNameError, upstreamSOA)))), client)
+
+	for range 2 {
+		if r := query(t, s, "app.example.com", dns.TypeA); r.Rcode != dns.RcodeNameError {
+			t.Fatalf("rcode before the ingress = %s, want the upstream NXDOMAIN", dns.RcodeToString[r.Rcode])
+		}
+	}
+	if n := exchanges.Load(); n != 1 {
+		t.Fatalf("upstream got %d queries, want the NXDOMAIN cached", n)
+	}
+
+	ingress := withStatus(newIngress("app", "app.example.com"), "10.0.0.2")
+	if _, err := client.NetworkingV1().Ingresses("default").Create(context.Background(), ingress, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("creating ingress: %v", err)
+	}
+	waitFor(t, "the cached NXDOMAIN to be dropped", func() bool {
+		return slices.Equal(rdata(query(t, s, "app.example.com", dns.TypeA).Answer), []string{"A 10.0.0.2"})
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxWildcardNames bounds the names a nameWindow tracks, so a flood of
+// distinct names can't grow it further. The count saturates there.
+const maxWildcardNames = 100000
+
+// nameWindow counts the distinct names seen over a sliding window. Names are
+// kept in two generations of half the window each, so the count covers
+// between half and all of the window.
+type nameWindow struct {
+	mu       sync.Mutex
+	half     time.Duration
+	start    time.Time
+	current  map[string]bool
+	previous map[string]bool
+	// fresh is how many names in current aren't in previous.
+	fresh int
+	// warned is set once the threshold has been crossed in the current
+	// generation.
+	warned bool
+}
+
+func newNameWindow(window time.Duration) *nameWindow {
+	return &nameWindow{
+		half:     window / 2,
+		start:    time.Now(),
+		current:  make(map[string]bool),
+		previous: make(map[string]bool),
+	}
+}
+
+// add records a name and returns the distinct count, and whether the count
+// has just crossed threshold. Zero disables the threshold.
+func (w *nameWindow) add(name string, threshold int) (int, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.rotate()
+	if !w.current[name] && len(w.current) < maxWildcardNames {
+		w.current[name] = true
+		if !w.previous[name] {
+			w.fresh++
+		}
+	}
+	count := len(w.previous) + w.fresh
+	crossed := threshold > 0 && count > threshold && !w.warned
+	if crossed {
+		w.warned = true
+	}
+	return count, crossed
+}
+
+// count returns the distinct names seen over the window.
+func (w *nameWindow) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.rotate()
+	return len(w.previous) + w.fresh
+}
+
+func (w *nameWindow) rotate() {
+	elapsed := time.Since(w.start)
+	if elapsed < w.half {
+		return
+	}
+	if elapsed < 2*w.half {
+		w.previous = w.current
+	} else {
+		w.previous = make(map[string]bool)
+	}
+	w.current = make(map[string]bool)
+	w.fresh = 0
+	w.warned = false
+	w.start = time.Now()
+}
+
+// recordWildcardName counts a name answered through a wildcard match and
+// warns, once per generation, when too many distinct ones are.
+func (s *Server) recordWildcardName(ctx context.Context, name string, match ingressMatch) {
+	if s.wildcardNames == nil {
+		return
+	}
+	count, crossed := s.wildcardNames.add(dns.CanonicalName(name), s.config().WildcardWarnNames)
+	if crossed {
+		queryLogger(ctx).Warn("Many distinct names answered through wildcards, possible subdomain enumeration",
+			"names", count,
+			"window", s.config().WildcardWindow,
+			"namespace", match.Namespace,
+			"ingress", match.Ingress,
+			"rule", match.Rule,
+		)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestWildcardCardinality(t *testing.T) {
+	logs := captureLogs(t)
+	s := newTestServer(t, map[string]string{"WILDCARD_WARN_NAMES": "20"},
+		newIngress("wildcard", "*.example.com"), newIngress("exact", "www.example.com"))
+	for i := range 50 {
+		query(t, s, fmt.Sprintf("host-%d.example.com", i), dns.TypeA)
+		// Names already seen, answered from the cache or not, and exact
+		// matches don't add to the count.
+		query(t, s, fmt.Sprintf("HOST-%d.example.com", i), dns.TypeAAAA)
+		query(t, s, "www.example.com", dns.TypeA)
+	}
+	if got := s.wildcardNames.count(); got != 50 {
+		t.Errorf("count = %d, want 50", got)
+	}
+	warnings := logs.records(t, "Many distinct names answered through wildcards, possible subdomain enumeration")
+	if len(warnings) != 1 {
+		t.Fatalf("warned %d times, want once", len(warnings))
+	}
+	if warnings[0]["names"] != float64(21) || warnings[0]["rule"] != "*.example.com." {
+		t.Errorf("warning = %v, want it at 21 names for *.example.com.", warnings[0])
+	}
+}
+
+func TestNameWindow(t *testing.T) {
+	w := newNameWindow(time.Minute)
+	for _, name := range []string{"a.", "b.", "a."} {
+		w.add(name, 0)
+	}
+	if got := w.count(); got != 2 {
+		t.Errorf("count = %d, want 2", got)
+	}
+	if _, crossed := w.add("c.", 2); !crossed {
+		t.Error("crossing the threshold not reported")
+	}
+	if _, crossed := w.add("d.", 2); crossed {
+		t.Error("threshold reported crossed twice in one generation")
+	}
+
+	// After half a window the names move to the previous generation and
+	// still count, after a whole window they are gone.
+	w.start = w.start.Add(-w.half)
+	count, crossed := w.add("a.", 2)
+	if count != 4 || !crossed {
+		t.Errorf("after half a window: count %d, crossed %t, want 4 and a new warning", count, crossed)
+	}
+	w.start = w.start.Add(-2 * w.half)
+	if got := w.count(); got != 0 {
+		t.Errorf("after a whole window: count = %d, want 0", got)
+	}
+}
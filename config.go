@@ -0,0 +1,594 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Config is the environment-derived configuration, read once at startup.
+type Config struct {
+	DNSPort string
+	PodIP   string
+	// DNSBindAddr is the address every DNS listener binds to, IPv4 or IPv6
+	// with or without brackets. Empty means POD_IP, which itself defaults to
+	// all interfaces. Both 0.0.0.0 and [::] listen dual-stack where the
+	// platform allows it.
+	DNSBindAddr string
+	// ReusePort sets SO_REUSEPORT on the DNS listeners so several instances
+	// can share the port, e.g. during a rolling restart on the host network.
+	ReusePort bool
+	// DoTPort serves DNS-over-TLS when TLSCert and TLSKey are both set.
+	DoTPort string
+	TLSCert string
+	TLSKey  string
+	// DoHAddr serves DNS-over-HTTPS on /dns-query when set, over TLS with
+	// TLSCert and TLSKey if both are given.
+	DoHAddr string
+
+	// IngressIPs and IngressIPv6s are the validated INGRESS_IP and
+	// INGRESS_IPV6 addresses answered for hosts without a load balancer
+	// status.
+	IngressIPs   []string
+	IngressIPv6s []string
+	// IngressHostname is set instead of IngressIPs when INGRESS_IP is a DNS
+	// name, such as a load balancer hostname; hosts are then answered with
+	// its resolved addresses, or a CNAME to it until it has been resolved.
+	IngressHostname string
+	// IngressIPRefresh is how often IngressHostname is resolved to answer
+	// with its addresses directly instead of a CNAME. Zero answers with the
+	// CNAME only.
+	IngressIPRefresh time.Duration
+	// RotateIngressIPs rotates the order of multiple ingress addresses on
+	// every response.
+	RotateIngressIPs bool
+	// IngressIPWeights are the weights given to IngressIPs and IngressIPv6s
+	// as ip:weight, or [ip]:weight for IPv6. When any address has one, the
+	// addresses are ordered at random with each coming first in proportion
+	// to its weight, instead of being rotated; the others weigh 1.
+	IngressIPWeights map[string]int
+	DNSTTL           uint32
+
+	// WatchNamespaces limits the served ingresses to these namespaces; empty
+	// means all namespaces.
+	WatchNamespaces []string
+	// IngressClass limits the served ingresses to a single class; empty
+	// means every class.
+	IngressClass string
+	// RequireAnnotation serves only ingresses annotated with
+	// enabledAnnotation: "true".
+	RequireAnnotation bool
+	// WatchServices also serves LoadBalancer services under the hostnames
+	// in their hostnameAnnotation.
+	WatchServices bool
+	// WildcardMultiLevel lets *.example.com match a.b.example.com too,
+	// instead of only names with exactly one extra label.
+	WildcardMultiLevel bool
+	// WildcardIncludesApex lets *.example.com match example.com too.
+	WildcardIncludesApex bool
+	// StripSuffixes are fully qualified, lowercase suffixes removed from
+	// names that match nothing before trying again.
+	StripSuffixes []string
+	// MatchEmptyHost answers every otherwise unmatched name for ingresses
+	// with a rule without a host. By default such rules are ignored.
+	MatchEmptyHost bool
+	// MatchTLSHosts also answers the hosts listed under an ingress's TLS
+	// section, for setups that declare hosts there without a rule.
+	MatchTLSHosts bool
+
+	FallbackDNS     []string
+	FallbackTimeout time.Duration
+	// FallbackNet is the transport used to reach FallbackDNS: udp, tcp or
+	// tcp-tls. Truncated UDP responses are retried over TCP.
+	FallbackNet string
+	// FallbackStrategy is sequential to try FallbackDNS in order, or
+	// fastest to query them all at once and use the first usable answer.
+	FallbackStrategy string
+	// ZoneForwarders maps lowercase FQDNs of zones to the servers that names in
+	// them are forwarded to instead of FallbackDNS, from ZONE_FORWARDERS
+	// entries of the form zone=host:port.
+	ZoneForwarders map[string][]string
+	// DisableFallback makes the server authoritative-only: names that match
+	// no ingress are answered with UnmatchedRcode instead of being forwarded.
+	DisableFallback bool
+	// NoIPBehavior is how a matched host without any usable address is
+	// answered: servfail, nodata (with the zone's SOA) or fallback to the
+	// upstream servers.
+	NoIPBehavior string
+	// MergeFallback adds the upstream records to the answer for a matched
+	// host for types other than A and AAAA, such as MX or TXT.
+	MergeFallback bool
+	// ForwardECS passes the EDNS Client Subnet option of a query on to the
+	// fallback servers, so geo-aware upstreams answer for the client rather
+	// than for us. Such answers aren't cached.
+	ForwardECS     bool
+	UnmatchedRcode int
+	// Zones are the fully qualified, lowercase zones this server is
+	// authoritative for: they get an SOA record, and unmatched names inside
+	// them are answered NXDOMAIN rather than forwarded.
+	Zones    []string
+	SOAMname string
+	SOARname string
+
+	// ChaseCNAME resolves the target of CNAMEs synthesized from a load
+	// balancer hostname upstream and includes the result in the answer.
+	ChaseCNAME bool
+	// MinimalANY answers ANY queries for a known name with a single HINFO
+	// record as RFC 8482 suggests, instead of all of its addresses.
+	MinimalANY bool
+
+	// AllowCIDRs, when set, limits the clients served to these networks.
+	// DenyCIDRs are refused even if they are allowed.
+	AllowCIDRs []*net.IPNet
+	DenyCIDRs  []*net.IPNet
+	// DenyNames are answered NXDOMAIN without consulting the ingresses or
+	// the fallback servers. They are matched against the lowercase query
+	// name without the trailing dot.
+	DenyNames []*regexp.Regexp
+
+	// RateLimit is the number of queries per second each client may send,
+	// with bursts of up to RateBurst; zero disables rate limiting. At most
+	// RateLimitClients clients are tracked at once.
+	RateLimit        float64
+	RateBurst        int
+	RateLimitClients int
+	// WildcardWindow is the sliding window over which the distinct names
+	// answered through wildcard matches are counted, zero to not count
+	// them. A warning is logged when more than WildcardWarnNames are, as a
+	// sign of subdomain enumeration; zero disables the warning.
+	WildcardWindow    time.Duration
+	WildcardWarnNames int
+
+	// AllowAXFR enables zone transfers of Zones over TCP, limited to clients
+	// in AXFRAllowCIDRs when that is set.
+	AllowAXFR      bool
+	AXFRAllowCIDRs []*net.IPNet
+
+	// MaintenanceHosts maps lowercase FQDNs of ingress hosts to the
+	// addresses answered for them ahead of every other source, from
+	// MAINTENANCE_HOSTS entries of the form host=ip.
+	MaintenanceHosts map[string][]string
+
+	// StaticHosts is a hosts file consulted before the ingresses, re-read
+	// every StaticHostsReload when it changes.
+	StaticHosts       string
+	StaticHostsReload time.Duration
+	// SnapshotPath is a file the synced ingresses are saved to every
+	// SnapshotInterval and loaded from at startup, so the last known hosts
+	// are served if the API server can't be reached until the cache syncs.
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+	// SelfNames are lowercase FQDNs answered with PodIP, so the server can
+	// resolve its own names without a separate record.
+	SelfNames []string
+
+	// MaxAnswerRecords caps the A and AAAA records in a UDP response; a
+	// reply with more is cut down and marked truncated so the client retries
+	// over TCP. Zero means no cap.
+	MaxAnswerRecords int
+	// MaxUDPSize caps the size of UDP responses below what the client's EDNS0
+	// buffer allows, for paths with a small MTU where fragments get dropped.
+	// Zero means no cap beyond EDNS0.
+	MaxUDPSize int
+
+	// OutOfCluster lets the server use a kubeconfig when it isn't running
+	// in a pod, for local development.
+	OutOfCluster bool
+
+	CacheSize int
+	// NegativeTTL is how long, in seconds, an upstream NXDOMAIN or NODATA
+	// without an SOA record is cached.
+	NegativeTTL    uint32
+	KubeAPITimeout time.Duration
+	// InformerResync is how often the informers replay their whole cache;
+	// zero relies on watch events alone.
+	InformerResync time.Duration
+	// StaleAfter is how long the cache may go without being confirmed in
+	// sync with the API server before StaleBehavior kicks in: servfail
+	// answers ingress lookups with SERVFAIL, notready only fails /readyz.
+	// Zero disables the check.
+	StaleAfter    time.Duration
+	StaleBehavior string
+	// QueryTimeout bounds the time spent answering a query, including API
+	// and fallback calls; replies that miss it are dropped, as the client
+	// has most likely given up. Zero means no limit.
+	QueryTimeout    time.Duration
+	ShutdownTimeout time.Duration
+	// ShutdownDelay keeps answering queries for this long after a shutdown
+	// signal with /readyz failing, so the pod is taken out of the Service
+	// endpoints before its listeners close.
+	ShutdownDelay time.Duration
+
+	MetricsAddr string
+	HealthAddr  string
+	LogLevel    string
+	LogFormat   string
+}
+
+// loadConfig reads the configuration from the environment. Malformed
+// optional values fall back to their defaults with a warning; malformed
+// addresses are an error.
+func loadConfig() (*Config, error) {
+	cfg := &Config{
+		DNSPort:              getEnv("DNS_PORT", "53"),
+		PodIP:                getEnv("POD_IP", "0.0.0.0"),
+		DNSBindAddr:          getEnv("DNS_BIND_ADDR", ""),
+		ReusePort:            getEnvBool("REUSE_PORT", false),
+		DoTPort:              getEnv("DOT_PORT", "853"),
+		TLSCert:              getEnv("TLS_CERT", ""),
+		TLSKey:               getEnv("TLS_KEY", ""),
+		DoHAddr:              getEnv("DOH_ADDR", ""),
+		NoIPBehavior:         getEnv("NO_IP_BEHAVIOR", "servfail"),
+		IngressIPRefresh:     getEnvDuration("INGRESS_IP_REFRESH", time.Minute),
+		RotateIngressIPs:     getEnvBool("ROTATE_INGRESS_IPS", false),
+		DNSTTL:               uint32(getEnvInt("DNS_TTL", 30)),
+		WatchNamespaces:      getEnvList("WATCH_NAMESPACES", nil),
+		IngressClass:         getEnv("INGRESS_CLASS", ""),
+		RequireAnnotation:    getEnvBool("REQUIRE_ANNOTATION", false),
+		WatchServices:        getEnvBool("WATCH_SERVICES", false),
+		MatchEmptyHost:       getEnvBool("MATCH_EMPTY_HOST", false),
+		MatchTLSHosts:        getEnvBool("MATCH_TLS_HOSTS", false),
+		WildcardMultiLevel:   getEnvBool("WILDCARD_MULTILEVEL", false),
+		WildcardIncludesApex: getEnvBool("WILDCARD_INCLUDES_APEX", false),
+		FallbackDNS:          getEnvList("FALLBACK_DNS", []string{"1.1.1.1:53"}),
+		FallbackTimeout:      getEnvDuration("FALLBACK_TIMEOUT", 2*time.Second),
+		FallbackStrategy:     getEnv("FALLBACK_STRATEGY", "sequential"),
+		FallbackNet:          getEnv("FALLBACK_NET", "udp"),
+		DisableFallback:      getEnvBool("DISABLE_FALLBACK", false),
+		MergeFallback:        getEnvBool("MERGE_FALLBACK", false),
+		ForwardECS:           getEnvBool("FORWARD_ECS", false),
+		UnmatchedRcode:       getEnvRcode("UNMATCHED_RCODE", dns.RcodeNameError),
+		ChaseCNAME:           getEnvBool("CHASE_CNAME", true),
+		MinimalANY:           getEnvBool("MINIMAL_ANY", false),
+		SOAMname:             getEnv("SOA_MNAME", ""),
+		SOARname:             getEnv("SOA_RNAME", ""),
+		AllowAXFR:            getEnvBool("ALLOW_AXFR", false),
+		RateLimit:            getEnvFloat("RATE_LIMIT", 0),
+		RateBurst:            getEnvInt("RATE_BURST", 20),
+		RateLimitClients:     getEnvInt("RATE_LIMIT_CLIENTS", 10000),
+		WildcardWindow:       getEnvDuration("WILDCARD_WINDOW", 5*time.Minute),
+		WildcardWarnNames:    getEnvInt("WILDCARD_WARN_NAMES", 1000),
+		StaticHosts:          getEnv("STATIC_HOSTS", ""),
+		StaticHostsReload:    getEnvDuration("STATIC_HOSTS_RELOAD", 30*time.Second),
+		SnapshotPath:         getEnv("SNAPSHOT_PATH", ""),
+		SnapshotInterval:     getEnvDuration("SNAPSHOT_INTERVAL", time.Minute),
+		MaxAnswerRecords:     getEnvInt("MAX_ANSWER_RECORDS", 0),
+		MaxUDPSize:           getEnvInt("MAX_UDP_SIZE", 0),
+		OutOfCluster:         getEnvBool("OUT_OF_CLUSTER", false),
+		NegativeTTL:          uint32(getEnvInt("NEGATIVE_TTL", 30)),
+		CacheSize:            getEnvInt("CACHE_SIZE", 1024),
+		KubeAPITimeout:       getEnvDuration("KUBE_API_TIMEOUT", 2*time.Second),
+		InformerResync:       getEnvDuration("INFORMER_RESYNC", 0),
+		StaleAfter:           getEnvDuration("STALE_AFTER", 0),
+		StaleBehavior:        getEnv("STALE_BEHAVIOR", "notready"),
+		QueryTimeout:         getEnvDuration("QUERY_TIMEOUT", 5*time.Second),
+		ShutdownTimeout:      getEnvDuration("SHUTDOWN_TIMEOUT", 5*time.Second),
+		ShutdownDelay:        getEnvDuration("SHUTDOWN_DELAY", 0),
+		MetricsAddr:          getEnv("METRICS_ADDR", ":9153"),
+		HealthAddr:           getEnv("HEALTH_ADDR", ":8080"),
+		LogLevel:             getEnv("LOG_LEVEL", "info"),
+		LogFormat:            getEnv("LOG_FORMAT", "text"),
+	}
+
+	for _, zone := range getEnvList("ZONE", nil) {
+		cfg.Zones = append(cfg.Zones, dns.CanonicalName(zone))
+	}
+	for _, suffix := range getEnvList("STRIP_SUFFIX", nil) {
+		cfg.StripSuffixes = append(cfg.StripSuffixes, dns.CanonicalName(suffix))
+	}
+
+	var err error
+	if cfg.DNSPort, err = parsePort(cfg.DNSPort); err != nil {
+		return nil, fmt.Errorf("invalid DNS_PORT: %w", err)
+	}
+	if cfg.DNSBindAddr != "" {
+		ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(cfg.DNSBindAddr, "["), "]"))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid DNS_BIND_ADDR %q: not an IP address", cfg.DNSBindAddr)
+		}
+		cfg.DNSBindAddr = ip.String()
+	}
+	if cfg.DoTPort, err = parsePort(cfg.DoTPort); err != nil {
+		return nil, fmt.Errorf("invalid DOT_PORT: %w", err)
+	}
+	switch cfg.FallbackStrategy {
+	case "sequential", "fastest":
+	default:
+		return nil, fmt.Errorf("invalid FALLBACK_STRATEGY %q: must be sequential or fastest", cfg.FallbackStrategy)
+	}
+	if cfg.MaxUDPSize != 0 && (cfg.MaxUDPSize < dns.MinMsgSize || cfg.MaxUDPSize > dns.MaxMsgSize) {
+		return nil, fmt.Errorf("invalid MAX_UDP_SIZE %d: must be between %d and %d", cfg.MaxUDPSize, dns.MinMsgSize, dns.MaxMsgSize)
+	}
+	switch cfg.NoIPBehavior {
+	case "servfail", "nodata", "fallback":
+	default:
+		return nil, fmt.Errorf("invalid NO_IP_BEHAVIOR %q: must be servfail, nodata or fallback", cfg.NoIPBehavior)
+	}
+	switch cfg.StaleBehavior {
+	case "servfail", "notready":
+	default:
+		return nil, fmt.Errorf("invalid STALE_BEHAVIOR %q: must be servfail or notready", cfg.StaleBehavior)
+	}
+	switch cfg.FallbackNet {
+	case "udp", "tcp", "tcp-tls":
+	default:
+		return nil, fmt.Errorf("invalid FALLBACK_NET %q: must be udp, tcp or tcp-tls", cfg.FallbackNet)
+	}
+
+	if cfg.AllowCIDRs, err = parseCIDRs(getEnvList("ALLOW_CIDRS", nil)); err != nil {
+		return nil, fmt.Errorf("invalid ALLOW_CIDRS: %w", err)
+	}
+	if cfg.DenyCIDRs, err = parseCIDRs(getEnvList("DENY_CIDRS", nil)); err != nil {
+		return nil, fmt.Errorf("invalid DENY_CIDRS: %w", err)
+	}
+	if cfg.AXFRAllowCIDRs, err = parseCIDRs(getEnvList("AXFR_ALLOW_CIDRS", nil)); err != nil {
+		return nil, fmt.Errorf("invalid AXFR_ALLOW_CIDRS: %w", err)
+	}
+	if cfg.DenyNames, err = parseRegexps(getEnvList("DENY_NAME_REGEX", nil)); err != nil {
+		return nil, fmt.Errorf("invalid DENY_NAME_REGEX: %w", err)
+	}
+	if cfg.ZoneForwarders, err = parseZoneForwarders(getEnvList("ZONE_FORWARDERS", nil)); err != nil {
+		return nil, fmt.Errorf("invalid ZONE_FORWARDERS: %w", err)
+	}
+	if cfg.MaintenanceHosts, err = parseMaintenanceHosts(getEnvList("MAINTENANCE_HOSTS", nil)); err != nil {
+		return nil, fmt.Errorf("invalid MAINTENANCE_HOSTS: %w", err)
+	}
+	for _, name := range getEnvList("SELF_NAMES", nil) {
+		cfg.SelfNames = append(cfg.SelfNames, dns.CanonicalName(name))
+	}
+	if ip := net.ParseIP(cfg.PodIP); len(cfg.SelfNames) > 0 && (ip == nil || ip.IsUnspecified()) {
+		return nil, fmt.Errorf("SELF_NAMES requires POD_IP to be set to the pod's address, got %q", cfg.PodIP)
+	}
+	ingressIP := getEnvList("INGRESS_IP", []string{cfg.PodIP})
+	if isHostname(ingressIP) {
+		cfg.IngressHostname = dns.Fqdn(ingressIP[0])
+	} else if cfg.IngressIPs, err = parseIPs(ingressIP, false, cfg.addWeight); err != nil {
+		return nil, fmt.Errorf("invalid INGRESS_IP: %w", err)
+	}
+	cfg.IngressIPv6s, err = parseIPs(getEnvList("INGRESS_IPV6", nil), true, cfg.addWeight)
+	if err != nil {
+		return nil, fmt.Errorf("invalid INGRESS_IPV6: %w", err)
+	}
+	return cfg, nil
+}
+
+// listenAddr composes the address a DNS listener binds to on port.
+func (c *Config) listenAddr(port string) string {
+	host := c.DNSBindAddr
+	if host == "" {
+		host = c.PodIP
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// parsePort validates a port number and returns it in canonical form.
+func parsePort(value string) (string, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("%q is not a port number between 1 and 65535", value)
+	}
+	return strconv.Itoa(port), nil
+}
+
+// isHostname reports whether INGRESS_IP is a single DNS name rather than a
+// list of addresses.
+func isHostname(values []string) bool {
+	if len(values) != 1 || net.ParseIP(values[0]) != nil {
+		return false
+	}
+	_, ok := dns.IsDomainName(values[0])
+	return ok && strings.Contains(values[0], ".") && !strings.Contains(values[0], ":")
+}
+
+// addWeight records the weight of an ingress address.
+func (c *Config) addWeight(ip string, weight int) {
+	if c.IngressIPWeights == nil {
+		c.IngressIPWeights = make(map[string]int)
+	}
+	c.IngressIPWeights[ip] = weight
+}
+
+// parseIPs validates that every value is an IPv4 address, or an IPv6 address
+// when ipv6 is set, and returns them in canonical form. Addresses given a
+// weight are passed to addWeight.
+func parseIPs(values []string, ipv6 bool, addWeight func(ip string, weight int)) ([]string, error) {
+	family := "IPv4"
+	if ipv6 {
+		family = "IPv6"
+	}
+
+	var ips []string
+	for _, value := range values {
+		weight := 0
+		if host, w, err := net.SplitHostPort(value); err == nil {
+			if weight, err = strconv.Atoi(w); err != nil || weight < 1 {
+				return nil, fmt.Errorf("%q does not have a positive weight", value)
+			}
+			value = host
+		}
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP address", value)
+		}
+		if ipv6 != (ip.To4() == nil) {
+			return nil, fmt.Errorf("%q is not an %s address", value, family)
+		}
+		ips = append(ips, ip.String())
+		if weight > 0 {
+			addWeight(ip.String(), weight)
+		}
+	}
+	return ips, nil
+}
+
+// parseMaintenanceHosts parses host=ip entries. A host listed several times
+// gets all of its addresses.
+func parseMaintenanceHosts(values []string) (map[string][]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	hosts := make(map[string][]string)
+	for _, value := range values {
+		host, addr, ok := strings.Cut(value, "=")
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if !ok || ip == nil {
+			return nil, fmt.Errorf("%q is not of the form host=ip", value)
+		}
+		host = dns.CanonicalName(strings.TrimSpace(host))
+		hosts[host] = append(hosts[host], ip.String())
+	}
+	return hosts, nil
+}
+
+// parseZoneForwarders parses zone=host:port entries. A zone listed several
+// times is forwarded to each of its servers in turn.
+func parseZoneForwarders(values []string) (map[string][]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	forwarders := make(map[string][]string)
+	for _, value := range values {
+		zone, server, ok := strings.Cut(value, "=")
+		zone, server = strings.TrimSpace(zone), strings.TrimSpace(server)
+		if !ok || zone == "" {
+			return nil, fmt.Errorf("%q is not of the form zone=host:port", value)
+		}
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, fmt.Errorf("%q: %w", value, err)
+		}
+		zone = dns.CanonicalName(zone)
+		forwarders[zone] = append(forwarders[zone], server)
+	}
+	return forwarders, nil
+}
+
+func parseRegexps(values []string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, value := range values {
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// parseCIDRs parses networks in CIDR notation. A bare address is treated as
+// a single-host network.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or network", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func getEnv(key, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("Invalid boolean in environment", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		slog.Warn("Invalid integer in environment", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < 0 {
+		slog.Warn("Invalid number in environment", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvList(key string, fallback []string) []string {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		slog.Warn("Invalid duration in environment", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvRcode(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	rcode, ok := dns.StringToRcode[strings.ToUpper(value)]
+	if !ok {
+		slog.Warn("Invalid rcode in environment", "key", key, "value", value, "default", dns.RcodeToString[fallback])
+		return fallback
+	}
+	return rcode
+}
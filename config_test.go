@@ -0,0 +1,208 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseIPs(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		ipv6    bool
+		want    []string
+		wantErr bool
+	}{
+		{"IPv4", []string{"10.0.0.1", "10.0.0.2"}, false, []string{"10.0.0.1", "10.0.0.2"}, false},
+		{"IPv6", []string{"2001:DB8::1"}, true, []string{"2001:db8::1"}, false},
+		{"empty", nil, false, nil, false},
+		{"not an IP", []string{"10.0.0"}, false, nil, true},
+		{"IPv6 as INGRESS_IP", []string{"2001:db8::1"}, false, nil, true},
+		{"IPv4 as INGRESS_IPV6", []string{"10.0.0.1"}, true, nil, true},
+		{"one bad among good", []string{"10.0.0.1", "bogus"}, false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseIPs(tt.values, tt.ipv6, func(string, int) {})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseIPs(%q) error = %v, want error %t", tt.values, err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseIPs(%q) = %q, want %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("INGRESS_IP", "10.0.0.1, 10.0.0.2")
+	t.Setenv("INGRESS_IPV6", "2001:db8::1")
+	t.Setenv("DNS_TTL", "120")
+	t.Setenv("FALLBACK_DNS", "192.0.2.53:53,192.0.2.54:53")
+	t.Setenv("FALLBACK_TIMEOUT", "500ms")
+	t.Setenv("WATCH_NAMESPACES", "team-a,team-b")
+	t.Setenv("ZONE", "Example.COM")
+	t.Setenv("DISABLE_FALLBACK", "yes") // not a boolean, so the default
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"IngressIPs", cfg.IngressIPs, []string{"10.0.0.1", "10.0.0.2"}},
+		{"IngressIPv6s", cfg.IngressIPv6s, []string{"2001:db8::1"}},
+		{"DNSTTL", cfg.DNSTTL, uint32(120)},
+		{"FallbackDNS", cfg.FallbackDNS, []string{"192.0.2.53:53", "192.0.2.54:53"}},
+		{"FallbackTimeout", cfg.FallbackTimeout, 500 * time.Millisecond},
+		{"WatchNamespaces", cfg.WatchNamespaces, []string{"team-a", "team-b"}},
+		{"Zones", cfg.Zones, []string{"example.com."}},
+		{"DisableFallback", cfg.DisableFallback, false},
+		{"DNSPort", cfg.DNSPort, "53"},
+		{"UnmatchedRcode", cfg.UnmatchedRcode, dns.RcodeNameError},
+	}
+	for _, c := range checks {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"INGRESS_IP":        "10.0.0.1,bogus",
+		"INGRESS_IPV6":      "10.0.0.1",
+		"FALLBACK_STRATEGY": "random",
+		"ALLOW_CIDRS":       "10.0.0.0/33",
+	}
+	for key, value := range tests {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), key) {
+				t.Errorf("loadConfig with %s=%q: error = %v, want one naming %s", key, value, err, key)
+			}
+		})
+	}
+}
+
+func TestIsHostname(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   bool
+	}{
+		{[]string{"ingress.example.net"}, true},
+		{[]string{"10.0.0.1"}, false},
+		{[]string{"2001:db8::1"}, false},
+		{[]string{"10.0.0.1:3"}, false},
+		{[]string{"localhost"}, false},
+		{[]string{"a.example.net", "b.example.net"}, false},
+	}
+	for _, tt := range tests {
+		if got := isHostname(tt.values); got != tt.want {
+			t.Errorf("isHostname(%q) = %t, want %t", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"pod IP", map[string]string{"POD_IP": "10.0.0.5"}, "10.0.0.5:53"},
+		{"default", nil, "0.0.0.0:53"},
+		{"bind address", map[string]string{"POD_IP": "10.0.0.5", "DNS_BIND_ADDR": "127.0.0.1"}, "127.0.0.1:53"},
+		{"IPv6 bind address", map[string]string{"DNS_BIND_ADDR": "::1"}, "[::1]:53"},
+		{"bracketed IPv6 bind address", map[string]string{"DNS_BIND_ADDR": "[::]"}, "[::]:53"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cfg, err := loadConfig()
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if got := cfg.listenAddr("53"); got != tt.want {
+				t.Errorf("listenAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Setenv("DNS_BIND_ADDR", "dns.example.com")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig accepted a hostname as DNS_BIND_ADDR")
+	}
+}
+
+func TestInformerResync(t *testing.T) {
+	for value, want := range map[string]time.Duration{"": 0, "30s": 30 * time.Second, "0": 0} {
+		t.Setenv("INFORMER_RESYNC", value)
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("loadConfig: %v", err)
+		}
+		if cfg.InformerResync != want {
+			t.Errorf("INFORMER_RESYNC=%q: InformerResync = %v, want %v", value, cfg.InformerResync, want)
+		}
+	}
+}
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"53", "53", false},
+		{"5353", "5353", false},
+		{"0053", "53", false},
+		{"65535", "65535", false},
+		{"", "", true},
+		{"dns", "", true},
+		{"53udp", "", true},
+		{"0", "", true},
+		{"-1", "", true},
+		{"65536", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parsePort(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parsePort(%q) = %q, %v, want %q, error %t", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	t.Setenv("DNS_PORT", "99999")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "DNS_PORT") {
+		t.Errorf("loadConfig with DNS_PORT=99999: error = %v, want one naming DNS_PORT", err)
+	}
+}
+
+func TestParseIPWeights(t *testing.T) {
+	t.Setenv("INGRESS_IP", "10.0.0.1:3,10.0.0.2")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if want := []string{"10.0.0.1", "10.0.0.2"}; !slices.Equal(cfg.IngressIPs, want) {
+		t.Errorf("IngressIPs = %v, want %v", cfg.IngressIPs, want)
+	}
+	if want := map[string]int{"10.0.0.1": 3}; !reflect.DeepEqual(cfg.IngressIPWeights, want) {
+		t.Errorf("IngressIPWeights = %v, want %v", cfg.IngressIPWeights, want)
+	}
+	for _, value := range []string{"10.0.0.1:0", "10.0.0.1:-1", "10.0.0.1:heavy"} {
+		t.Setenv("INGRESS_IP", value)
+		if _, err := loadConfig(); err == nil {
+			t.Errorf("loadConfig with INGRESS_IP=%s succeeded, want an error", value)
+		}
+	}
+}
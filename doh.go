@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// dohContentType is the RFC 8484 media type of wire-format DNS messages.
+const dohContentType = "application/dns-message"
+
+// startDoHServer serves RFC 8484 DNS-over-HTTPS on /dns-query, over TLS when
+// a certificate is given and plain HTTP otherwise, e.g. behind an ingress
+// that terminates TLS.
+func (s *Server) startDoHServer(addr string, cert *tls.Certificate) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", s.handleDoH)
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	if cert != nil {
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12}
+	}
+	go func() {
+		slog.Info("Starting DoH server", "addr", server.Addr, "tls", cert != nil)
+		var err error
+		if cert != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			slog.Error("DoH server stopped", "err", err)
+		}
+	}()
+	return server
+}
+
+// handleDoH decodes a query from the dns parameter of a GET or the body of a
+// POST and answers it through handleDNSRequest.
+func (s *Server) handleDoH(w http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil || len(wire) == 0 {
+			http.Error(w, "missing or invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		wire, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if err != nil || len(wire) == 0 || len(wire) > dns.MaxMsgSize {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(wire); err != nil {
+		http.Error(w, "malformed dns message", http.StatusBadRequest)
+		return
+	}
+
+	rw := &dohResponseWriter{remote: dohAddr(r.RemoteAddr)}
+	s.handleDNSRequest(rw, req)
+	if rw.msg == nil {
+		http.Error(w, "no response", http.StatusServiceUnavailable)
+		return
+	}
+	packed, err := rw.msg.Pack()
+	if err != nil {
+		slog.Error("Failed to pack DoH response", "name", questionName(rw.msg), "err", err)
+		http.Error(w, "failed to pack response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := minTTL(rw.msg); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(packed)
+}
+
+// minTTL is the smallest TTL in a reply, which RFC 8484 uses to bound HTTP
+// caching.
+func minTTL(m *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if !found || rr.Header().Ttl < ttl {
+				ttl, found = rr.Header().Ttl, true
+			}
+		}
+	}
+	return ttl, found
+}
+
+func questionName(m *dns.Msg) string {
+	if len(m.Question) == 0 {
+		return ""
+	}
+	return m.Question[0].Name
+}
+
+// dohAddr is the HTTP client address. It is neither a UDP nor a TCP address,
+// so DoH replies are never truncated and zone transfers are refused.
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
+
+// dohResponseWriter captures the reply handleDNSRequest writes so it can be
+// sent back as the HTTP response body.
+type dohResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr       { return dohAddr("") }
+func (w *dohResponseWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *dohResponseWriter) Close() error              { return nil }
+func (w *dohResponseWriter) TsigStatus() error         { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool)       {}
+func (w *dohResponseWriter) Hijack()                   {}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// dohRequest builds a DoH request of method for a query of name.
+func dohRequest(t testing.TB, method, name string) *http.Request {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	req.Id = 0 // RFC 8484 recommends ID 0 for cacheability
+	wire, err := req.Pack()
+	if err != nil {
+		t.Fatalf("packing query: %v", err)
+	}
+	if method == http.MethodGet {
+		return httptest.NewRequest(method, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(wire), nil)
+	}
+	r := httptest.NewRequest(method, "/dns-query", bytes.NewReader(wire))
+	r.Header.Set("Content-Type", dohContentType)
+	return r
+}
+
+func TestDoH(t *testing.T) {
+	s := newTestServer(t, map[string]string{"DNS_TTL": "120"}, withStatus(newIngress("app", "app.example.com"), "10.0.0.2"))
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.handleDoH(rec, dohRequest(t, method, "app.example.com"))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d (%s), want %d", rec.Code, strings.TrimSpace(rec.Body.String()), http.StatusOK)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != dohContentType {
+				t.Errorf("Content-Type = %q, want %q", ct, dohContentType)
+			}
+			if cc := rec.Header().Get("Cache-Control"); cc != "max-age=120" {
+				t.Errorf("Cache-Control = %q, want max-age=120", cc)
+			}
+			r := new(dns.Msg)
+			if err := r.Unpack(rec.Body.Bytes()); err != nil {
+				t.Fatalf("unpacking reply: %v", err)
+			}
+			if got := rdata(r.Answer); !slices.Equal(got, []string{"A 10.0.0.2"}) {
+				t.Errorf("answer = %q, want [A 10.0.0.2]", got)
+			}
+		})
+	}
+}
+
+func TestDoHBadRequests(t *testing.T) {
+	s := newTestServer(t, nil)
+	wrongType := dohRequest(t, http.MethodPost, "app.example.com")
+	wrongType.Header.Set("Content-Type", "application/json")
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"GET without dns", httptest.NewRequest(http.MethodGet, "/dns-query", nil), http.StatusBadRequest},
+		{"GET with invalid base64", httptest.NewRequest(http.MethodGet, "/dns-query?dns=!!!", nil), http.StatusBadRequest},
+		{"GET with garbage", httptest.NewRequest(http.MethodGet, "/dns-query?dns=AAAA", nil), http.StatusBadRequest},
+		{"POST of another type", wrongType, http.StatusUnsupportedMediaType},
+		{"PUT", httptest.NewRequest(http.MethodPut, "/dns-query", nil), http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		s.handleDoH(rec, tt.req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+}
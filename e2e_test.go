@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// startDNSServer serves the handler of s over UDP and TCP on an ephemeral
+// port of the loopback and returns its address.
+func startDNSServer(t testing.TB, s *Server) string {
+	t.Helper()
+	return serveDNS(t, "127.0.0.1:0", dns.HandlerFunc(s.handleDNSRequest))
+}
+
+func TestEndToEnd(t *testing.T) {
+	upstream := startUpstream(t, answerWith("A 192.0.2.1"))
+	client := fake.NewSimpleClientset(
+		withStatus(newIngress("app", "app.example.com"), "10.0.0.2"),
+		newIngress("wildcard", "*.apps.example.com"),
+	)
+	s := newInformerServer(t, fallbackEnv(upstream), client)
+	addr := startDNSServer(t, s)
+
+	tests := []struct {
+		name      string
+		net       string
+		host      string
+		answer    []string
+		recursion bool
+	}{
+		{"matched", "udp", "app.example.com", []string{"A 10.0.0.2"}, false},
+		{"matched over TCP", "tcp", "app.example.com", []string{"A 10.0.0.2"}, false},
+		{"wildcard", "udp", "web.apps.example.com", []string{"A 10.0.0.1"}, false},
+		{"fallback", "udp", "example.org", []string{"A 192.0.2.1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &dns.Client{Net: tt.net, Timeout: 2 * time.Second}
+			req := new(dns.Msg)
+			req.SetQuestion(dns.Fqdn(tt.host), dns.TypeA)
+			r, _, err := c.Exchange(req, addr)
+			if err != nil {
+				t.Fatalf("exchange: %v", err)
+			}
+			if r.Id != req.Id || !r.Response || r.Rcode != dns.RcodeSuccess || r.Truncated {
+				t.Errorf("reply header = %+v, want a NOERROR response to ID %d", r.MsgHdr, req.Id)
+			}
+			if r.RecursionAvailable != tt.recursion {
+				t.Errorf("RA = %t, want %t", r.RecursionAvailable, tt.recursion)
+			}
+			if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+		})
+	}
+}
+
+func TestEndToEndTruncation(t *testing.T) {
+	ips := make([]string, 40)
+	for i := range ips {
+		ips[i] = net.IPv4(10, 0, 1, byte(i+1)).String()
+	}
+	s := newTestServer(t, nil, withStatus(newIngress("big", "big.example.com"), ips...))
+	addr := startDNSServer(t, s)
+
+	req := new(dns.Msg)
+	req.SetQuestion("big.example.com.", dns.TypeA)
+	r, _, err := (&dns.Client{Timeout: 2 * time.Second}).Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("exchange over UDP: %v", err)
+	}
+	if !r.Truncated || len(r.Answer) >= len(ips) {
+		t.Errorf("UDP reply has TC %t and %d answers, want it truncated", r.Truncated, len(r.Answer))
+	}
+	r, _, err = (&dns.Client{Net: "tcp", Timeout: 2 * time.Second}).Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("exchange over TCP: %v", err)
+	}
+	if r.Truncated || len(r.Answer) != len(ips) {
+		t.Errorf("TCP reply has TC %t and %d answers, want all %d", r.Truncated, len(r.Answer), len(ips))
+	}
+}
+
+func TestIPv6Listener(t *testing.T) {
+	if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	} else {
+		l.Close()
+	}
+	env := map[string]string{"DNS_BIND_ADDR": "[::1]", "ALLOW_CIDRS": "::1/128", "RATE_LIMIT": "1", "RATE_BURST": "1"}
+	s := newTestServer(t, env, newIngress("app", "app.example.com"))
+	// The address main listens on, with an ephemeral port.
+	addr := serveDNS(t, s.config().listenAddr("0"), dns.HandlerFunc(s.handleDNSRequest))
+	if host, _, _ := net.SplitHostPort(addr); host != "::1" {
+		t.Errorf("listening on %s, want ::1", addr)
+	}
+
+	for i, network := range []string{"udp", "tcp"} {
+		req := new(dns.Msg)
+		req.SetQuestion("app.example.com.", dns.TypeA)
+		r, _, err := (&dns.Client{Net: network, Timeout: 2 * time.Second}).Exchange(req, addr)
+		if err != nil {
+			t.Fatalf("exchange over %s: %v", network, err)
+		}
+		// The IPv6 client is allowed, and its single token is spent on the
+		// first query.
+		want := []string{"A 10.0.0.1"}
+		if i > 0 {
+			want = nil
+		}
+		if got := rdata(r.Answer); !slices.Equal(got, want) {
+			t.Errorf("%s query %d: %s %q, want %q", network, i+1, dns.RcodeToString[r.Rcode], got, want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+type clientSubnetKey struct{}
+
+// clientSubnet returns the EDNS Client Subnet option of r, with the address
+// cut down to its source prefix, or nil if r has none or it is malformed.
+func clientSubnet(r *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		ecs, ok := option.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		bits := 8 * net.IPv4len
+		if ecs.Family == 2 {
+			bits = 8 * net.IPv6len
+		} else if ecs.Family != 1 {
+			return nil
+		}
+		// RFC 7871 requires a zero scope in queries.
+		if int(ecs.SourceNetmask) > bits || ecs.SourceScope != 0 || ecs.Address == nil {
+			return nil
+		}
+		address := ecs.Address.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits))
+		if address == nil {
+			return nil
+		}
+		return &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        ecs.Family,
+			SourceNetmask: ecs.SourceNetmask,
+			Address:       address,
+		}
+	}
+	return nil
+}
+
+// withClientSubnet returns a context carrying the client subnet forwarded
+// with the query's fallback lookups.
+func withClientSubnet(ctx context.Context, ecs *dns.EDNS0_SUBNET) context.Context {
+	return context.WithValue(ctx, clientSubnetKey{}, ecs)
+}
+
+// clientSubnetFrom returns the client subnet of the query ctx belongs to,
+// or nil.
+func clientSubnetFrom(ctx context.Context) *dns.EDNS0_SUBNET {
+	ecs, _ := ctx.Value(clientSubnetKey{}).(*dns.EDNS0_SUBNET)
+	return ecs
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// subnetQuery builds an A query for name carrying an ECS option for
+// address/bits.
+func subnetQuery(name, address string, bits uint8) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	req.SetEdns0(1232, false)
+	family := uint16(1)
+	if net.ParseIP(address).To4() == nil {
+		family = 2
+	}
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: bits, Address: net.ParseIP(address)})
+	return req
+}
+
+func TestForwardECS(t *testing.T) {
+	var mu sync.Mutex
+	var received []*dns.EDNS0_SUBNET
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		received = append(received, clientSubnetOption(r))
+		mu.Unlock()
+		answerWith("A 192.0.2.1")(w, r)
+	})
+	tests := []struct {
+		name    string
+		forward string
+		req     *dns.Msg
+		want    string // the subnet upstream sees, "" for none
+	}{
+		{"IPv4", "true", subnetQuery("one.example.org", "198.51.100.77", 24), "198.51.100.0/24"},
+		{"IPv6", "true", subnetQuery("two.example.org", "2001:db8:1:2::1", 48), "2001:db8:1::/48"},
+		{"disabled", "false", subnetQuery("three.example.org", "198.51.100.77", 24), ""},
+		{"bad prefix", "true", subnetQuery("four.example.org", "198.51.100.77", 33), ""},
+		{"no option", "true", new(dns.Msg).SetQuestion("five.example.org.", dns.TypeA), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			received = nil
+			mu.Unlock()
+			env := fallbackEnv(upstream)
+			env["FORWARD_ECS"] = tt.forward
+			s := newTestServer(t, env)
+			if r := exchange(t, s, tt.req, udpClient); len(r.Answer) != 1 {
+				t.Fatalf("answer = %v, want the upstream's", r.Answer)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(received) != 1 {
+				t.Fatalf("upstream got %d queries, want 1", len(received))
+			}
+			got := ""
+			if ecs := received[0]; ecs != nil {
+				got = fmt.Sprintf("%s/%d", ecs.Address, ecs.SourceNetmask)
+				if ecs.SourceScope != 0 {
+					t.Errorf("forwarded scope = %d, want 0", ecs.SourceScope)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("upstream saw subnet %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// clientSubnetOption returns the ECS option of r as sent, or nil.
+func clientSubnetOption(r *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := r.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return ecs
+			}
+		}
+	}
+	return nil
+}
+
+func TestECSBypassesCache(t *testing.T) {
+	var mu sync.Mutex
+	subnets := make(map[string]int)
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		if ecs := clientSubnetOption(r); ecs != nil {
+			subnets[ecs.Address.String()]++
+		}
+		mu.Unlock()
+		answerWith("A 192.0.2.1")(w, r)
+	})
+	env := fallbackEnv(upstream)
+	env["FORWARD_ECS"] = "true"
+	s := newTestServer(t, env)
+	for _, address := range []string{"198.51.100.1", "203.0.113.1", "198.51.100.1"} {
+		exchange(t, s, subnetQuery("geo.example.org", address, 24), udpClient)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if subnets["198.51.100.0"] != 2 || subnets["203.0.113.0"] != 1 {
+		t.Errorf("upstream queries by subnet = %v, want each query forwarded", subnets)
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import "errors"
+
+// The reasons a question can't be answered from the ingresses. processQuery
+// picks the rcode from them: SERVFAIL when the ingresses couldn't be read, so
+// the client retries instead of caching a false negative, NXDOMAIN or
+// fallback when nothing matched, and NO_IP_BEHAVIOR when a host matched but
+// has no address to answer with.
+var (
+	errAPIUnavailable = errors.New("ingresses unavailable")
+	errNoMatch        = errors.New("no ingress matches")
+	errNoAddress      = errors.New("matched host has no address")
+)
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// explanation describes how a name would be resolved against the current
+// configuration and ingress cache.
+type explanation struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Source is where the answer comes from, as decided for processQuery.
+	Source   answerSource   `json:"source"`
+	Matches  []ingressMatch `json:"matches"`
+	Zone     string         `json:"zone,omitempty"`
+	Fallback bool           `json:"fallback"`
+}
+
+// handleExplain runs the answer precedence for ?name= and the optional
+// ?type= (A by default) without serving DNS, so support can see why a host
+// does or doesn't resolve. It shares priorSource, matchQuestion and
+// matchedSource with processQuery so the two can't drift apart.
+func (s *Server) handleExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimSuffix(r.URL.Query().Get("name"), ".")
+	if name == "" {
+		http.Error(w, "missing name parameter", http.StatusBadRequest)
+		return
+	}
+	qtype := dns.TypeA
+	if value := r.URL.Query().Get("type"); value != "" {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(value)]; !ok {
+			http.Error(w, "unknown type parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result := explanation{
+		Name:    name,
+		Type:    dns.Type(qtype).String(),
+		Matches: []ingressMatch{},
+		Zone:    s.zoneFor(name),
+	}
+	source, _ := s.priorSource(name)
+	if source == "" {
+		ingresses, err := s.fetchIngresses(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		q := dns.Question{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET}
+		matches, err := s.matchQuestion(ingresses, q, name, result.Zone)
+		if matches != nil {
+			result.Matches = matches
+		}
+		source = s.matchedSource(name, result.Zone, err)
+	}
+	result.Source = source
+	result.Fallback = source == sourceFallback || source == sourceIngress && result.Zone == "" && s.mergesFallback(name, qtype)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// explain asks s's /explain handler about name and decodes the reply.
+func explain(t testing.TB, s *Server, params url.Values) (int, map[string]any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleExplain(rec, httptest.NewRequest(http.MethodGet, "/explain?"+params.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		return rec.Code, nil
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var result map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	return rec.Code, result
+}
+
+func TestExplain(t *testing.T) {
+	s := newTestServer(t, nil, withStatus(newIngress("app", "app.example.com"), "10.0.0.2"))
+
+	_, matched := explain(t, s, url.Values{"name": {"app.example.com."}})
+	for key, want := range map[string]any{"name": "app.example.com", "type": "A", "fallback": false} {
+		if matched[key] != want {
+			t.Errorf("matched %s = %v, want %v", key, matched[key], want)
+		}
+	}
+	matches, _ := matched["matches"].([]any)
+	if len(matches) != 1 {
+		t.Fatalf("matched matches = %v, want one", matched["matches"])
+	}
+	want := map[string]any{
+		"name": "app.example.com.", "ips": []any{"10.0.0.2"}, "namespace": "default", "ingress": "app",
+		"rule": "app.example.com.", "wildcard": false, "ttl": float64(30),
+	}
+	if !reflect.DeepEqual(matches[0], want) {
+		t.Errorf("match = %v, want %v", matches[0], want)
+	}
+
+	_, unmatched := explain(t, s, url.Values{"name": {"missing.example.org"}})
+	if got, ok := unmatched["matches"].([]any); !ok || len(got) != 0 {
+		t.Errorf("unmatched matches = %#v, want an empty list", unmatched["matches"])
+	}
+
+	for _, params := range []url.Values{{}, {"name": {"app.example.com"}, "type": {"BOGUS"}}} {
+		if code, _ := explain(t, s, params); code != http.StatusBadRequest {
+			t.Errorf("explain %v: status = %d, want %d", params, code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+)
+
+func FuzzHandleDNSRequest(f *testing.F) {
+	for _, seed := range []*dns.Msg{
+		new(dns.Msg).SetQuestion("app.example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("app.example.com.", dns.TypeAAAA),
+		new(dns.Msg).SetQuestion("foo.example.org.", dns.TypeANY),
+		new(dns.Msg).SetQuestion("2.0.0.10.in-addr.arpa.", dns.TypePTR),
+		new(dns.Msg).SetEdns0(4096, true),
+		{MsgHdr: dns.MsgHdr{Id: 1}},
+	} {
+		wire, err := seed.Pack()
+		if err != nil {
+			f.Fatalf("packing seed %v: %v", seed, err)
+		}
+		f.Add(wire)
+	}
+
+	cfg := testConfig(f, map[string]string{"ZONE": "example.com", "INGRESS_IPV6": "2001:db8::1"})
+	s := newServer(cfg, nil)
+	indexer := newIndexer(f,
+		withStatus(newIngress("app", "app.example.com"), "10.0.0.2"),
+		withStatus(newIngress("wildcard", "*.example.com"), "lb.example.net"),
+		newIngress("malformed", "*.", ""),
+	)
+	s.ingressListers = []networkinglisters.IngressLister{networkinglisters.NewIngressLister(indexer)}
+	s.cacheSynced.Store(true)
+
+	f.Fuzz(func(t *testing.T, wire []byte) {
+		req := new(dns.Msg)
+		if err := req.Unpack(wire); err != nil {
+			return
+		}
+		for _, remote := range []net.Addr{udpClient, &net.TCPAddr{IP: udpClient.IP, Port: udpClient.Port}} {
+			w := &testWriter{remote: remote}
+			s.handleDNSRequest(w, req)
+			for _, r := range w.msgs {
+				if !r.Response || r.Id != req.Id {
+					t.Fatalf("reply %v to %v is not a response with the query's ID", r, req)
+				}
+				packed, err := r.Pack()
+				if err != nil {
+					t.Fatalf("reply to %v doesn't pack: %v", req, err)
+				}
+				if _, isUDP := remote.(*net.UDPAddr); isUDP && len(packed) > dns.DefaultMsgSize {
+					t.Fatalf("UDP reply of %d bytes", len(packed))
+				}
+				if err := new(dns.Msg).Unpack(packed); err != nil {
+					t.Fatalf("reply to %v doesn't unpack: %v", req, err)
+				}
+			}
+		}
+	})
+}
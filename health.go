@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// startHealthServer serves the probes and /config. /explain reads the
+// listers, so it is added by serveExplain once they are built.
+func (s *Server) startHealthServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/config", s.handleConfig)
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		slog.Info("Starting health server", "addr", server.Addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			slog.Error("Health server stopped", "err", err)
+		}
+	}()
+	return server
+}
+
+// serveExplain adds /explain to the health server started by
+// startHealthServer. It must not be called before initIngressInformer.
+func (s *Server) serveExplain(server *http.Server) {
+	server.Handler.(*http.ServeMux).HandleFunc("/explain", s.handleExplain)
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if !s.cacheSynced.Load() {
+		http.Error(w, "ingress cache not synced", http.StatusServiceUnavailable)
+		return
+	}
+	if s.cacheStale() && s.config().StaleBehavior == "notready" {
+		http.Error(w, "ingress cache stale", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// configDump is the effective configuration as served by /config, with the
+// networks written in CIDR notation. Only file paths are exposed for the
+// TLS certificate and key, never their contents.
+type configDump struct {
+	*Config
+	AllowCIDRs     []string
+	DenyCIDRs      []string
+	AXFRAllowCIDRs []string
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dump := configDump{
+		Config:         s.config(),
+		AllowCIDRs:     formatCIDRs(s.config().AllowCIDRs),
+		DenyCIDRs:      formatCIDRs(s.config().DenyCIDRs),
+		AXFRAllowCIDRs: formatCIDRs(s.config().AXFRAllowCIDRs),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dump)
+}
+
+func formatCIDRs(networks []*net.IPNet) []string {
+	cidrs := make([]string, 0, len(networks))
+	for _, network := range networks {
+		cidrs = append(cidrs, network.String())
+	}
+	return cidrs
+}
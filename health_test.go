@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name   string
+		synced bool
+		status int
+	}{
+		{"synced", true, http.StatusOK},
+		{"not synced", false, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			s.cacheSynced.Store(tt.synced)
+			rec := httptest.NewRecorder()
+			s.handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestExplainServedAfterInformers(t *testing.T) {
+	s := newTestServer(t, nil, newIngress("app", "app.example.com"))
+	server := s.startHealthServer("127.0.0.1:0")
+	t.Cleanup(func() { server.Close() })
+
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz = %d, want %d", code, http.StatusOK)
+	}
+	if code := get("/explain?name=app.example.com"); code != http.StatusNotFound {
+		t.Errorf("/explain before serveExplain = %d, want %d", code, http.StatusNotFound)
+	}
+	s.serveExplain(server)
+	if code := get("/explain?name=app.example.com"); code != http.StatusOK {
+		t.Errorf("/explain after serveExplain = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestConfigEndpoint(t *testing.T) {
+	s := newTestServer(t, map[string]string{
+		"ZONE":        "example.com",
+		"ALLOW_CIDRS": "10.0.0.0/8",
+		"TLS_CERT":    "/etc/tls/tls.crt",
+		"TLS_KEY":     "/etc/tls/tls.key",
+	})
+	rec := httptest.NewRecorder()
+	s.handleConfig(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	var dump map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &dump); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	for key, want := range map[string]any{
+		"DNSPort":    "53",
+		"DNSTTL":     float64(30),
+		"TLSCert":    "/etc/tls/tls.crt",
+		"Zones":      []any{"example.com."},
+		"AllowCIDRs": []any{"10.0.0.0/8"},
+	} {
+		if got := dump[key]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s = %#v, want %#v", key, got, want)
+		}
+	}
+	if strings.Contains(rec.Body.String(), "PRIVATE KEY") {
+		t.Error("config dump contains key material")
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleConfig(rec, httptest.NewRequest(http.MethodPost, "/config", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	s := newTestServer(t, nil, newIngress("app", "app.example.com"))
+	addr := startDNSServer(t, s)
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		s.handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("/readyz before draining = %d, want 200", code)
+	}
+
+	const delay = 300 * time.Millisecond
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		s.drain(delay)
+		close(done)
+	}()
+	waitFor(t, "/readyz to fail", func() bool { return ready() == http.StatusServiceUnavailable })
+
+	// Queries are still answered while the endpoints catch up.
+	req := new(dns.Msg)
+	req.SetQuestion("app.example.com.", dns.TypeA)
+	r, _, err := (&dns.Client{Timeout: time.Second}).Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("query while draining: %v", err)
+	}
+	if got := rdata(r.Answer); !slices.Equal(got, []string{"A 10.0.0.1"}) {
+		t.Errorf("answer while draining = %q, want [A 10.0.0.1]", got)
+	}
+	select {
+	case <-done:
+		t.Fatal("drain returned before answering the query")
+	default:
+	}
+
+	<-done
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("drain returned after %s, want at least %s", elapsed, delay)
+	}
+}
+
+func TestDrainWithoutDelay(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.drain(0)
+	if s.draining.Load() {
+		t.Error("drain without SHUTDOWN_DELAY failed /readyz")
+	}
+}
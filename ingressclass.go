@@ -0,0 +1,30 @@
+package main
+
+import (
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+// legacyClassAnnotation is the pre-IngressClassName way of picking a class.
+const legacyClassAnnotation = "kubernetes.io/ingress.class"
+
+// ingressClassName is the class an ingress asks for, from its spec or the
+// legacy annotation.
+func ingressClassName(ingress *networkingv1.Ingress) string {
+	if ingress.Spec.IngressClassName != nil {
+		return *ingress.Spec.IngressClassName
+	}
+	return ingress.Annotations[legacyClassAnnotation]
+}
+
+// ingressClassController resolves a class name to the controller of its
+// IngressClass resource, or "" if it isn't known.
+func (s *Server) ingressClassController(name string) string {
+	if s.ingressClassLister == nil || name == "" {
+		return ""
+	}
+	class, err := s.ingressClassLister.Get(name)
+	if err != nil {
+		return ""
+	}
+	return class.Spec.Controller
+}
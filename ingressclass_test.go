@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newIngressClass(name, controller string) *networkingv1.IngressClass {
+	return &networkingv1.IngressClass{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       networkingv1.IngressClassSpec{Controller: controller},
+	}
+}
+
+func TestIngressClassController(t *testing.T) {
+	ingresses := []*networkingv1.Ingress{
+		withClass(newIngress("internal", "internal.example.com"), "nginx-internal"),
+		withClass(newIngress("external", "external.example.com"), "nginx-external"),
+		withClass(newIngress("traefik", "traefik.example.com"), "traefik"),
+		withClass(newIngress("unknown", "unknown.example.com"), "missing"),
+	}
+	classes := newIndexer(t,
+		newIngressClass("nginx-internal", "k8s.io/ingress-nginx"),
+		newIngressClass("nginx-external", "k8s.io/ingress-nginx"),
+		newIngressClass("traefik", "traefik.io/ingress-controller"),
+	)
+	tests := []struct {
+		class  string
+		served map[string]bool
+	}{
+		{"k8s.io/ingress-nginx", map[string]bool{"internal.example.com": true, "external.example.com": true}},
+		{"nginx-internal", map[string]bool{"internal.example.com": true}},
+		{"traefik", map[string]bool{"traefik.example.com": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.class, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"INGRESS_CLASS": tt.class}, ingresses...)
+			s.ingressClassLister = networkinglisters.NewIngressClassLister(classes)
+			for _, ingress := range ingresses {
+				host := ingress.Spec.Rules[0].Host
+				r := query(t, s, host, dns.TypeA)
+				if served := r.Rcode == dns.RcodeSuccess; served != tt.served[host] {
+					t.Errorf("%s: rcode = %s, want served = %t", host, dns.RcodeToString[r.Rcode], tt.served[host])
+				}
+			}
+		})
+	}
+}
+
+func TestIngressClassesForbidden(t *testing.T) {
+	client := fake.NewSimpleClientset(withClass(newIngress("app", "app.example.com"), "nginx"))
+	client.PrependReactor("list", "ingressclasses", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "networking.k8s.io", Resource: "ingressclasses"}, "", nil)
+	})
+	s := newInformerServer(t, map[string]string{"INGRESS_CLASS": "nginx", "KUBE_API_TIMEOUT": "500ms"}, client)
+
+	if !s.cacheSynced.Load() {
+		t.Error("cache held up by the forbidden IngressClass informer")
+	}
+	if s.ingressClassLister != nil {
+		t.Error("IngressClass lister set without access to IngressClasses")
+	}
+	if r := query(t, s, "app.example.com", dns.TypeA); r.Rcode != dns.RcodeSuccess {
+		t.Errorf("rcode = %s, want the class name still matched", dns.RcodeToString[r.Rcode])
+	}
+}
+
+func TestCacheFlushedOnIngressClassChange(t *testing.T) {
+	client := fake.NewSimpleClientset(withClass(withStatus(newIngress("app", "app.example.com"), "10.0.0.2"), "nginx-internal"))
+	env := fallbackEnv(startUpstream(t, answerWith("A 192.0.2.1")))
+	env["INGRESS_CLASS"] = "k8s.io/ingress-nginx"
+	s := newInformerServer(t, env, client)
+
+	if got := rdata(query(t, s, "app.example.com", dns.TypeA).Answer); !slices.Equal(got, []string{"A 192.0.2.1"}) {
+		t.Fatalf("answer before the IngressClass = %q, want the upstream's", got)
+	}
+	class := newIngressClass("nginx-internal", "k8s.io/ingress-nginx")
+	if _, err := client.NetworkingV1().IngressClasses().Create(context.Background(), class, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("creating IngressClass: %v", err)
+	}
+	waitFor(t, "the cached upstream answer to be dropped", func() bool {
+		return slices.Equal(rdata(query(t, s, "app.example.com", dns.TypeA).Answer), []string{"A 10.0.0.2"})
+	})
+
+	class.Spec.Controller = "traefik.io/ingress-controller"
+	class.ResourceVersion = "2"
+	if _, err := client.NetworkingV1().IngressClasses().Update(context.Background(), class, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("updating IngressClass: %v", err)
+	}
+	waitFor(t, "the cached ingress answer to be dropped", func() bool {
+		return slices.Equal(rdata(query(t, s, "app.example.com", dns.TypeA).Answer), []string{"A 192.0.2.1"})
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+)
+
+// resolveIngressHostname looks up the addresses of INGRESS_IP when it is a
+// hostname, replacing the addresses answered for hosts without a load
+// balancer status. A failed lookup keeps the previous addresses.
+func (s *Server) resolveIngressHostname(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, s.config().FallbackTimeout)
+	defer cancel()
+
+	addrs, err := s.lookupHost(ctx, s.config().IngressHostname)
+	if err != nil {
+		slog.Warn("Failed to resolve INGRESS_IP hostname", "hostname", s.config().IngressHostname, "err", err)
+		return
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip.String())
+		}
+	}
+	slices.Sort(ips)
+	ips = slices.Compact(ips)
+
+	old := s.ingressHostIPs.Load()
+	s.ingressHostIPs.Store(&ips)
+	if old == nil || !slices.Equal(*old, ips) {
+		slog.Info("Resolved INGRESS_IP hostname", "hostname", s.config().IngressHostname, "ips", ips)
+		// Cached answers hold the previous addresses, or the CNAME answered
+		// until the first resolution.
+		s.responses.flush()
+	}
+}
+
+// watchIngressHostname re-resolves the INGRESS_IP hostname every interval,
+// so load balancers that change addresses are followed.
+func (s *Server) watchIngressHostname(interval time.Duration, stopCh <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	s.resolveIngressHostname(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.resolveIngressHostname(ctx)
+		}
+	}
+}
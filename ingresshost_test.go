@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeResolver is a lookupHost answering with addresses it can be told to
+// change, or an error.
+type fakeResolver struct {
+	mu    sync.Mutex
+	addrs []string
+	err   error
+}
+
+func (r *fakeResolver) set(err error, addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addrs, r.err = addrs, err
+}
+
+func (r *fakeResolver) lookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.addrs), r.err
+}
+
+func TestIngressHostnameRefresh(t *testing.T) {
+	resolver := &fakeResolver{}
+	resolver.set(nil, "10.0.0.8", "10.0.0.7", "10.0.0.7")
+	s := newTestServer(t, map[string]string{"INGRESS_IP": "ingress.example.net"}, newIngress("app", "app.example.com"))
+	s.lookupHost = resolver.lookupHost
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go s.watchIngressHostname(10*time.Millisecond, stopCh)
+
+	answer := func() []string { return rdata(query(t, s, "app.example.com", dns.TypeA).Answer) }
+	waitFor(t, "the first resolution", func() bool {
+		return slices.Equal(answer(), []string{"A 10.0.0.7", "A 10.0.0.8"})
+	})
+
+	resolver.set(errors.New("lookup failed"))
+	time.Sleep(50 * time.Millisecond)
+	if got := answer(); !slices.Equal(got, []string{"A 10.0.0.7", "A 10.0.0.8"}) {
+		t.Errorf("answer after a failed lookup = %q, want the previous addresses kept", got)
+	}
+
+	resolver.set(nil, "10.0.0.9")
+	waitFor(t, "the new addresses", func() bool {
+		return slices.Equal(answer(), []string{"A 10.0.0.9"})
+	})
+}
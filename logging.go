@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+)
+
+// initLogger installs the default slog logger configured by LOG_LEVEL
+// (debug, info, warn, error) and LOG_FORMAT (text or json).
+func initLogger(cfg *Config) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(cfg.LogFormat) {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// fatal logs msg at error level and exits, for failures during startup.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type queryLoggerKey struct{}
+
+// withQueryLogger returns a context carrying a logger that tags every event
+// of one query with a generated query ID and the client address, so the
+// events of concurrent queries can be told apart.
+func withQueryLogger(ctx context.Context, client net.IP) context.Context {
+	id := fmt.Sprintf("%016x", rand.Uint64())
+	return context.WithValue(ctx, queryLoggerKey{}, slog.With("query_id", id, "client", client))
+}
+
+// withSharedLogger returns a context for work shared by several queries,
+// such as a collapsed fallback exchange. It keeps the values of ctx, but not
+// its cancellation, and logs with the shared key rather than the query ID
+// of whichever query started the work.
+func withSharedLogger(ctx context.Context, key string) context.Context {
+	return context.WithValue(context.WithoutCancel(ctx), queryLoggerKey{}, slog.With("shared", key))
+}
+
+// queryLogger returns the logger of the query ctx belongs to, or the
+// default logger outside of a query.
+func queryLogger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(queryLoggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQueryIDInFallbackLogs(t *testing.T) {
+	upstream := startUpstream(t, answerWith("A 192.0.2.1"))
+	s := newTestServer(t, fallbackEnv(upstream))
+	logs := captureLogs(t)
+	query(t, s, "one.example.org", dns.TypeA)
+	query(t, s, "two.example.org", dns.TypeA)
+
+	ids := make(map[string]string)
+	for _, record := range logs.records(t, "Query") {
+		ids[record["name"].(string)] = record["query_id"].(string)
+		if record["client"] != "192.0.2.10" {
+			t.Errorf("query of %s logged client %v, want 192.0.2.10", record["name"], record["client"])
+		}
+	}
+	if len(ids) != 2 || ids["one.example.org"] == "" || ids["one.example.org"] == ids["two.example.org"] {
+		t.Fatalf("query IDs = %v, want a distinct one for each query", ids)
+	}
+
+	answers := logs.records(t, "Answer")
+	if len(answers) != 2 {
+		t.Fatalf("logged %d forwarded answers, want 2", len(answers))
+	}
+	for _, record := range answers {
+		name := record["name"].(string)
+		if record["query_id"] != ids[name] {
+			t.Errorf("forwarded answer for %s logged query ID %v, want %s", name, record["query_id"], ids[name])
+		}
+	}
+	// The exchange is shared by every query asking the same question, so it
+	// is logged under the question rather than any one query's ID.
+	for _, record := range logs.records(t, "Fallback DNS response") {
+		if _, ok := record["query_id"]; ok || record["shared"] == nil {
+			t.Errorf("upstream exchange logged %v, want it keyed by the question", record)
+		}
+	}
+}
@@ -2,149 +2,1523 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
-	"sync"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/miekg/dns"
 	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// enabledAnnotation opts an ingress into DNS serving when
+	// REQUIRE_ANNOTATION is set.
+	enabledAnnotation = "ingress-dns/enabled"
+	// ttlAnnotation overrides DNS_TTL, in seconds, for the records
+	// synthesized from an ingress.
+	ttlAnnotation = "ingress-dns/ttl"
+	// txtAnnotation holds the TXT records served for an ingress' hosts, one
+	// per line.
+	txtAnnotation = "ingress-dns/txt"
+	// matchAnnotation is a regular expression for extra names an ingress is
+	// served under, beyond the hosts of its rules.
+	matchAnnotation = "ingress-dns/match"
+	maxMatchPattern = 256
 )
 
 var (
-	kubeClient    *kubernetes.Clientset
-	dnsPort       = getEnv("DNS_PORT", "53")
-	podIP         = getEnv("POD_IP", "0.0.0.0")
-	fallbackDNS   = "1.1.1.1:53"
+	listBackoff   = wait.Backoff{Steps: 3, Duration: 50 * time.Millisecond, Factor: 2, Jitter: 0.1}
 	wildcardRegex = regexp.MustCompile(`^\*\.(?P<anydomain>[^*]+)$`)
 )
 
 func main() {
-	initKubeClient()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	configFile := newConfigFile(os.Getenv("CONFIG_FILE"))
+	if err := configFile.apply(); err != nil {
+		fatal("Failed to read config file", "err", err)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("Invalid configuration", "err", err)
+	}
+	initLogger(cfg)
+	if cfg.IngressHostname == "" && (len(cfg.IngressIPs) == 0 || net.ParseIP(cfg.IngressIPs[0]).IsUnspecified()) {
+		slog.Warn("INGRESS_IP is not set, hosts without a load balancer status will not resolve to a usable address", "ingress_ip", cfg.IngressIPs)
+	}
+
+	s := newServer(cfg, newKubeClient(cfg.OutOfCluster))
+	registerCacheMetrics(s)
+	healthServer := s.startHealthServer(cfg.HealthAddr)
+
+	stopCh := make(chan struct{})
+	go s.watchReload(configFile, stopCh)
+	if cfg.StaticHosts != "" {
+		if err := s.loadStaticHosts(cfg.StaticHosts); err != nil {
+			fatal("Failed to load static hosts", "err", err)
+		}
+		if cfg.StaticHostsReload > 0 {
+			go s.watchStaticHosts(cfg.StaticHosts, cfg.StaticHostsReload, stopCh)
+		}
+	}
+	if cfg.SnapshotPath != "" {
+		if err := s.loadSnapshot(cfg.SnapshotPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to load ingress snapshot", "err", err)
+		}
+		if cfg.SnapshotInterval > 0 {
+			go s.watchSnapshot(cfg.SnapshotPath, cfg.SnapshotInterval, stopCh)
+		}
+	}
+	if cfg.IngressHostname != "" && cfg.IngressIPRefresh > 0 {
+		go s.watchIngressHostname(cfg.IngressIPRefresh, stopCh)
+	}
+	s.initIngressInformer(stopCh)
+	s.serveExplain(healthServer)
+	if cfg.StaleAfter > 0 {
+		go s.watchStaleness(cfg.StaleAfter, stopCh)
+	}
+	metricsServer := startMetricsServer(cfg.MetricsAddr)
+
+	dns.HandleFunc(".", s.handleDNSRequest)
 
-	dns.HandleFunc(".", handleDNSRequest)
+	addr := cfg.listenAddr(cfg.DNSPort)
+	servers := []*dns.Server{
+		{Addr: addr, Net: "udp", ReusePort: cfg.ReusePort},
+		{Addr: addr, Net: "tcp", ReusePort: cfg.ReusePort},
+	}
+	var cert *tls.Certificate
+	if cfg.TLSCert != "" && cfg.TLSKey != "" {
+		loaded, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			fatal("Failed to load TLS certificate", "cert", cfg.TLSCert, "key", cfg.TLSKey, "err", err)
+		}
+		cert = &loaded
+		servers = append(servers, &dns.Server{
+			Addr:      cfg.listenAddr(cfg.DoTPort),
+			Net:       "tcp-tls",
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{*cert}, MinVersion: tls.VersionTLS12},
+			ReusePort: cfg.ReusePort,
+		})
+	}
 
-	server := &dns.Server{Addr: fmt.Sprintf("%s:%s", podIP, dnsPort), Net: "udp"}
-	log.Printf("Starting DNS server on %s\n", server.Addr)
+	httpServers := []*http.Server{healthServer, metricsServer}
+	if cfg.DoHAddr != "" {
+		httpServers = append(httpServers, s.startDoHServer(cfg.DoHAddr, cert))
+	}
+
+	errCh := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *dns.Server) {
+			slog.Info("Starting DNS server", "addr", server.Addr, "net", server.Net)
+			err := server.ListenAndServe()
+			errCh <- fmt.Errorf("%s server stopped: %v", server.Net, err)
+		}(server)
+	}
 
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	var serveErr error
+	select {
+	case serveErr = <-errCh:
+		slog.Error("Failed to serve DNS", "err", serveErr)
+	case <-ctx.Done():
+		slog.Info("Received shutdown signal")
+		s.drain(cfg.ShutdownDelay)
+	}
+
+	shutdown(cfg.ShutdownTimeout, servers, httpServers, stopCh)
+	if serveErr != nil {
+		os.Exit(1)
 	}
 }
 
-func initKubeClient() {
-	config, err := rest.InClusterConfig()
+// drain fails /readyz for delay while queries are still answered, so the
+// pod is taken out of the Service endpoints before its listeners stop.
+func (s *Server) drain(delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	slog.Info("Draining before shutdown", "delay", delay)
+	s.draining.Store(true)
+	time.Sleep(delay)
+}
+
+// shutdown stops the DNS listeners, giving in-flight requests up to timeout
+// to finish, then stops the HTTP servers and the informer.
+func shutdown(timeout time.Duration, dnsServers []*dns.Server, httpServers []*http.Server, stopCh chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, server := range dnsServers {
+		if err := server.ShutdownContext(ctx); err != nil {
+			slog.Warn("Failed to shut down DNS server", "net", server.Net, "err", err)
+		}
+	}
+	for _, server := range httpServers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("Failed to shut down HTTP server", "addr", server.Addr, "err", err)
+		}
+	}
+	close(stopCh)
+	slog.Info("Shutdown complete")
+}
+
+func newKubeClient(outOfCluster bool) *kubernetes.Clientset {
+	config, err := restConfig(outOfCluster)
 	if err != nil {
-		log.Fatalf("Failed to create in-cluster config: %v", err)
+		fatal("Failed to create kubernetes client config", "err", err)
 	}
 
-	kubeClient, err = kubernetes.NewForConfig(config)
+	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		log.Fatalf("Failed to create kubernetes client: %v", err)
+		fatal("Failed to create kubernetes client", "err", err)
+	}
+	return client
+}
+
+// restConfig returns the in-cluster config. With OUT_OF_CLUSTER set, it
+// falls back to the kubeconfig from KUBECONFIG or ~/.kube/config, for
+// running against a cluster from a workstation.
+func restConfig(outOfCluster bool) (*rest.Config, error) {
+	config, err := rest.InClusterConfig()
+	if err == nil || !outOfCluster {
+		return config, err
+	}
+	slog.Info("Not running in a cluster, loading kubeconfig", "err", err)
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+}
+
+func (s *Server) initIngressInformer(stopCh <-chan struct{}) {
+	var factories []informers.SharedInformerFactory
+	for _, namespace := range s.watchedNamespaces() {
+		// An informer for a namespace we may not list never syncs, and would
+		// hold up the whole cache.
+		if s.listForbidden(namespace, "ingresses") {
+			continue
+		}
+		factory := informers.NewSharedInformerFactoryWithOptions(s.kubeClient, s.config().InformerResync, informers.WithNamespace(namespace))
+		ingresses := factory.Networking().V1().Ingresses()
+		s.flushOnChange(ingresses.Informer())
+		s.trackInformer(ingresses.Informer())
+		s.ingressListers = append(s.ingressListers, ingresses.Lister())
+		if s.config().WatchServices && !s.listForbidden(namespace, "services") {
+			services := factory.Core().V1().Services()
+			s.flushOnChange(services.Informer())
+			s.trackInformer(services.Informer())
+			s.serviceListers = append(s.serviceListers, services.Lister())
+		}
+		factories = append(factories, factory)
 	}
+	if s.config().IngressClass != "" && !s.listForbidden(metav1.NamespaceAll, "ingressclasses") {
+		// IngressClasses are cluster-scoped, so they get their own factory
+		// even when only some namespaces are watched. Without access to
+		// them, INGRESS_CLASS only matches class names.
+		factory := informers.NewSharedInformerFactory(s.kubeClient, s.config().InformerResync)
+		classes := factory.Networking().V1().IngressClasses()
+		s.flushOnChange(classes.Informer())
+		s.trackInformer(classes.Informer())
+		s.ingressClassLister = classes.Lister()
+		factories = append(factories, factory)
+	}
+
+	slog.Info("Waiting for ingress cache to sync")
+	for _, factory := range factories {
+		factory.Start(stopCh)
+	}
+
+	// Don't hold up startup on a slow API server: if the first sync takes
+	// longer than KUBE_API_TIMEOUT, start serving (unmatched names are
+	// forwarded) and keep /readyz failing until the cache catches up.
+	ctx, cancel := context.WithTimeout(context.Background(), s.config().KubeAPITimeout)
+	defer cancel()
+	if waitForCacheSync(ctx.Done(), factories) {
+		s.markCacheSynced()
+		return
+	}
+	slog.Warn("Ingress cache not synced in time, forwarding queries until it is", "timeout", s.config().KubeAPITimeout)
+	go func() {
+		if waitForCacheSync(stopCh, factories) {
+			s.markCacheSynced()
+			slog.Info("Ingress cache synced")
+		}
+	}()
+}
+
+// flushOnChange empties the response cache whenever the informer sees an
+// object added, changed or deleted. Cached answers are looked up before the
+// ingresses, so an upstream answer or NXDOMAIN cached before a host's
+// ingress existed would otherwise outlive it by up to the upstream's TTL.
+// Resyncs, which replay unchanged objects, keep the cache.
+func (s *Server) flushOnChange(informer cache.SharedIndexInformer) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(any) { s.responses.flush() },
+		UpdateFunc: func(old, obj any) {
+			oldMeta, err1 := meta.Accessor(old)
+			newMeta, err2 := meta.Accessor(obj)
+			if err1 == nil && err2 == nil && oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() {
+				return
+			}
+			s.responses.flush()
+		},
+		DeleteFunc: func(any) { s.responses.flush() },
+	})
+}
+
+// listForbidden reports whether RBAC keeps us from listing the resource in
+// namespace, or cluster-wide for ingressclasses. Namespaces that can't be checked, e.g. while the API server is
+// unreachable, are assumed to be allowed.
+func (s *Server) listForbidden(namespace, resource string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config().KubeAPITimeout)
+	defer cancel()
+
+	var err error
+	opts := metav1.ListOptions{Limit: 1}
+	switch resource {
+	case "ingresses":
+		_, err = s.kubeClient.NetworkingV1().Ingresses(namespace).List(ctx, opts)
+	case "services":
+		_, err = s.kubeClient.CoreV1().Services(namespace).List(ctx, opts)
+	case "ingressclasses":
+		_, err = s.kubeClient.NetworkingV1().IngressClasses().List(ctx, opts)
+	}
+	if !apierrors.IsForbidden(err) {
+		return false
+	}
+	slog.Warn("Not allowed to list "+resource+", skipping them", "namespace", namespace, "err", err)
+	return true
+}
+
+// watchedNamespaces is WATCH_NAMESPACES, or all namespaces when unset.
+func (s *Server) watchedNamespaces() []string {
+	if len(s.config().WatchNamespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	return s.config().WatchNamespaces
 }
 
-func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+func waitForCacheSync(stopCh <-chan struct{}, factories []informers.SharedInformerFactory) bool {
+	for _, factory := range factories {
+		for _, synced := range factory.WaitForCacheSync(stopCh) {
+			if !synced {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *Server) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	defer func() { requestDuration.Observe(time.Since(start).Seconds()) }()
+
+	client := remoteIP(w.RemoteAddr())
+	if !s.clientAllowed(client) {
+		slog.Debug("Refused query from disallowed client", "client", client)
+		refuse(w, r)
+		return
+	}
+	if !s.limiter.allow(client) {
+		slog.Debug("Refused query from rate limited client", "client", client)
+		refuse(w, r)
+		return
+	}
+
+	// Only standard queries are served; UPDATE, NOTIFY and the rest are
+	// refused rather than answered as if they were lookups.
+	if r.Opcode != dns.OpcodeQuery {
+		slog.Debug("Refused non-query message", "client", client, "opcode", dns.OpcodeToString[r.Opcode])
+		refuse(w, r)
+		return
+	}
+	if len(r.Question) == 0 {
+		slog.Debug("Rejected query without a question", "client", client)
+		replyRcode(w, r, dns.RcodeFormatError)
+		return
+	}
+
+	if len(r.Question) == 1 && r.Question[0].Qtype == dns.TypeAXFR {
+		s.handleAXFR(w, r)
+		return
+	}
+
+	ctx, cancel := s.queryContext()
+	defer cancel()
+	ctx = withQueryLogger(ctx, client)
+	if s.config().ForwardECS {
+		if ecs := clientSubnet(r); ecs != nil {
+			ctx = withClientSubnet(ctx, ecs)
+		}
+	}
+
 	msg := dns.Msg{}
 	msg.SetReply(r)
+	msg.Question = r.Question // SetReply only keeps the first
+	msg.Authoritative = true  // Until a question isn't answered authoritatively
 
-	var wg sync.WaitGroup
+	// Questions are answered one after another, as clients almost always
+	// send a single one. Each is answered on its own so a failure in one
+	// doesn't clobber the others' records.
 	for _, q := range msg.Question {
-		wg.Add(1)
-		go func(q dns.Question) {
-			defer wg.Done()
-			processQuery(&msg, q)
-		}(q)
+		reply := new(dns.Msg)
+		s.processQuery(ctx, reply, q)
+		mergeReply(&msg, reply)
 	}
-	wg.Wait()
+	// Static hosts, ingresses, the cache and upstream each dedup their own
+	// records, but can still overlap with each other or across questions.
+	// dns.Dedup keys on owner, class, type and rdata and keeps the first.
+	msg.Answer = dns.Dedup(msg.Answer, nil)
+	msg.Ns = dns.Dedup(msg.Ns, nil)
+	msg.Extra = dns.Dedup(msg.Extra, nil)
 
+	// Echo EDNS0 with the buffer size the client advertised (capped at our
+	// own and MAX_UDP_SIZE), and truncate UDP replies to it so clients know
+	// to retry over TCP.
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = min(max(int(opt.UDPSize()), dns.MinMsgSize), dns.DefaultMsgSize)
+		if s.config().MaxUDPSize > 0 {
+			size = min(size, s.config().MaxUDPSize)
+		}
+		msg.SetEdns0(uint16(size), false)
+	}
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		capAddressRecords(&msg, s.config().MaxAnswerRecords)
+		msg.Truncate(size)
+	}
+
+	if ctx.Err() != nil {
+		queryLogger(ctx).Debug("Query timed out, dropping reply", "timeout", s.config().QueryTimeout)
+		return
+	}
 	w.WriteMsg(&msg)
 }
 
-func processQuery(m *dns.Msg, q dns.Question) {
-	if q.Qtype != dns.TypeA {
-		return // For simplicity, only handle TypeA queries
+// queryContext returns the context a query is answered under, bounded by
+// QUERY_TIMEOUT when that is set.
+func (s *Server) queryContext() (context.Context, context.CancelFunc) {
+	if s.config().QueryTimeout > 0 {
+		return context.WithTimeout(context.Background(), s.config().QueryTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// mergeReply adds the sections of one question's reply to m. The first
+// question that fails decides the rcode of the whole message, which is only
+// authoritative if every reply is.
+func mergeReply(m, reply *dns.Msg) {
+	m.Answer = append(m.Answer, reply.Answer...)
+	m.Ns = append(m.Ns, reply.Ns...)
+	m.Extra = append(m.Extra, reply.Extra...)
+	m.RecursionAvailable = m.RecursionAvailable || reply.RecursionAvailable
+	m.Authoritative = m.Authoritative && reply.Authoritative
+	if m.Rcode == dns.RcodeSuccess {
+		m.Rcode = reply.Rcode
+	}
+}
+
+// capAddressRecords keeps at most limit A and AAAA records in the answer,
+// setting the TC bit if any had to be dropped. Other records are kept.
+func capAddressRecords(m *dns.Msg, limit int) {
+	if limit <= 0 {
+		return
 	}
+	kept, count := m.Answer[:0], 0
+	for _, rr := range m.Answer {
+		if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			if count++; count > limit {
+				m.Truncated = true
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	m.Answer = kept
+}
+
+func refuse(w dns.ResponseWriter, r *dns.Msg) {
+	replyRcode(w, r, dns.RcodeRefused)
+}
 
+// replyRcode answers r with an empty reply carrying rcode.
+func replyRcode(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	w.WriteMsg(m)
+}
+
+// processQuery answers one question into m. Denied and reserved names and
+// cached replies aside, the sources are consulted in a fixed order and the
+// first that knows the name answers it alone. priorSource and matchedSource
+// decide which, for /explain as well:
+//
+//  1. MAINTENANCE_HOSTS overrides,
+//  2. STATIC_HOSTS and SELF_NAMES,
+//  3. the ingresses and services, adding the upstream records of other
+//     types with MERGE_FALLBACK,
+//  4. the fallback servers, unless the name is in a ZONE.
+func (s *Server) processQuery(ctx context.Context, m *dns.Msg, q dns.Question) {
+	queriesTotal.WithLabelValues(dns.Type(q.Qtype).String()).Inc()
+	start := time.Now()
 	name := q.Name[:len(q.Name)-1] // Remove trailing dot
-	log.Printf("-------------------------------\n")
-	log.Printf("Query: %v\n", name)
-	ingresses, err := fetchIngresses()
-	if err != nil {
-		log.Printf("Error fetching ingresses: %v\n", err)
+	first, firstNs := len(m.Answer), len(m.Ns)
+	matched, fallback, cached := 0, false, false
+	// Replies to queries with a forwarded client subnet may differ by subnet,
+	// so they bypass the cache.
+	subnet := clientSubnetFrom(ctx) != nil
+	defer func() {
+		// Rotated answers are not cached, or every hit would share one order.
+		// Negative answers are only cached when they came from upstream.
+		switch {
+		case cached || subnet || ((s.config().RotateIngressIPs || s.config().IngressIPWeights != nil) && matched > 0):
+		case m.Rcode == dns.RcodeSuccess && len(m.Answer) > first:
+			s.responses.set(q, m.Answer[first:], fallback)
+		case fallback && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError):
+			s.responses.setNegative(q, m.Rcode, m.Answer[first:], m.Ns[firstNs:])
+		}
+		queryLogger(ctx).Info("Query",
+			"name", name,
+			"qtype", dns.Type(q.Qtype).String(),
+			"matched", matched,
+			"fallback", fallback,
+			"cached", cached,
+			"rcode", dns.RcodeToString[m.Rcode],
+			"duration", time.Since(start),
+		)
+	}()
+
+	source, ips := s.priorSource(name)
+	switch source {
+	case sourceDenied:
+		queryLogger(ctx).Debug("Denied query for blocked name", "name", name)
+		m.Rcode = dns.RcodeNameError
+		return
+	case sourceReserved:
+		s.answerReserved(m, q)
 		return
 	}
 
-	confirmed, fallbackRequired := matchIngress(ingresses, name)
+	// Answers built from the ingress cache while it was fresh aren't served
+	// once it is stale and STALE_BEHAVIOR is servfail; forwarded ones are.
+	if r, ok := s.responses.get(q); ok && !subnet && (r.RecursionAvailable || !s.refuseStale()) {
+		cached = true
+		m.Rcode, m.RecursionAvailable = r.Rcode, r.RecursionAvailable
+		m.Authoritative = !r.RecursionAvailable && s.zoneFor(name) != ""
+		m.Answer = append(m.Answer, r.Answer...)
+		m.Ns = append(m.Ns, r.Ns...)
+		return
+	}
+
+	if source != "" {
+		matched = 1
+		m.Authoritative = s.zoneFor(name) != ""
+		s.answerStatic(m, q, ips)
+		return
+	}
 
-	for range confirmed {
-		rr, err := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, getEnv("INGRESS_IP", podIP)))
+	zone := s.zoneFor(name)
+	ingresses, err := s.fetchIngresses(ctx)
+	if err == nil {
+		matched, err = s.answerQuestion(ctx, m, q, name, zone, ingresses)
+	}
+	switch s.matchedSource(name, zone, err) {
+	case sourceIngress:
+		ingressMatchesTotal.Inc()
+		// A CNAME owner has no other data to merge with.
+		if zone == "" && s.mergesFallback(name, q.Qtype) && !slices.ContainsFunc(m.Answer[first:], isCNAME) {
+			fallback = true
+			s.mergeFallbackDNS(ctx, name, q.Qtype, m)
+		}
+	case sourceNoAddress:
+		if s.config().NoIPBehavior == "nodata" {
+			if zone != "" {
+				m.Ns = append(m.Ns, s.newSOA(zone))
+			}
+			break
+		}
+		queryLogger(ctx).Debug("Matched host has no address", "name", name)
+		m.Rcode = dns.RcodeServerFailure
+	case sourceError:
+		queryLogger(ctx).Error("Failed to fetch ingresses", "name", name, "err", err)
+		m.Rcode = dns.RcodeServerFailure
+	case sourceZone:
+		// We are authoritative for the zone, so the name doesn't exist. The
+		// apex always exists (it holds the SOA) and gets NODATA instead.
+		if dns.CanonicalName(q.Name) != zone {
+			m.Rcode = dns.RcodeNameError
+		}
+		m.Ns = append(m.Ns, s.newSOA(zone))
+	case sourceUnmatched:
+		m.Rcode = s.config().UnmatchedRcode
+	case sourceFallback:
+		fallback = true
+		s.queryFallbackDNS(ctx, name, q.Qtype, m)
+	}
+	// Only what we answer ourselves for a ZONE is authoritative.
+	m.Authoritative = zone != "" && !fallback && m.Rcode != dns.RcodeServerFailure
+}
+
+// answerQuestion appends the records the ingresses hold for q and reports
+// how many hosts matched, or errNoMatch if none did.
+func (s *Server) answerQuestion(ctx context.Context, m *dns.Msg, q dns.Question, name, zone string, ingresses []*networkingv1.Ingress) (int, error) {
+	first := len(m.Answer)
+	switch {
+	case q.Qtype == dns.TypePTR:
+		hosts := s.matchReverse(ingresses, name)
+		for _, host := range hosts {
+			m.Answer = append(m.Answer, s.newPTR(q.Name, host))
+		}
+		if len(hosts) == 0 {
+			return 0, errNoMatch
+		}
+		return len(hosts), nil
+	case q.Qtype == dns.TypeSOA && zone != "" && dns.CanonicalName(q.Name) == zone:
+		m.Answer = append(m.Answer, s.newSOA(zone))
+		return 1, nil
+	case q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA:
+		return s.answerIngress(ctx, m, q, name, ingresses)
+	case q.Qtype == dns.TypeANY && s.config().MinimalANY:
+		confirmed, err := s.matchName(ingresses, name)
 		if err == nil {
-			log.Printf("Answer: %v\n", rr.String())
+			m.Answer = append(m.Answer, newHINFO(q.Name, confirmed[0].TTL))
+		}
+		return len(confirmed), err
+	case q.Qtype == dns.TypeANY:
+		// ANY is answered with every address type we synthesize.
+		matched, err := s.answerIngress(ctx, m, withQtype(q, dns.TypeA), name, ingresses)
+		if err == nil {
+			s.answerIngress(ctx, m, withQtype(q, dns.TypeAAAA), name, ingresses)
+			m.Answer = dns.Dedup(m.Answer, nil)
+		}
+		return matched, err
+	case q.Qtype == dns.TypeTXT:
+		confirmed, err := s.matchName(ingresses, name)
+		for _, match := range confirmed {
+			for _, text := range match.TXT {
+				m.Answer = append(m.Answer, newTXT(q.Name, match.TTL, text))
+			}
+		}
+		if err == nil && len(m.Answer) == first && !s.answerCNAME(ctx, m, q, confirmed) && zone != "" {
+			m.Ns = append(m.Ns, s.newSOA(zone))
+		}
+		return len(confirmed), err
+	default:
+		// Other types on an ingress host get its CNAME, if it has one, or
+		// NODATA; unknown names are forwarded.
+		confirmed, err := s.matchName(ingresses, name)
+		if err == nil && !s.answerCNAME(ctx, m, q, confirmed) && zone != "" {
+			m.Ns = append(m.Ns, s.newSOA(zone))
+		}
+		return len(confirmed), err
+	}
+}
+
+// answerCNAME appends the CNAME of a matched host answered with one, for
+// query types other than A and AAAA: a CNAME owner has no other data (RFC
+// 1034), so it is the answer to every type. It reports whether the host has
+// a CNAME.
+func (s *Server) answerCNAME(ctx context.Context, m *dns.Msg, q dns.Question, confirmed []ingressMatch) bool {
+	for _, match := range confirmed {
+		if !s.hasAddress(match) {
+			continue
+		}
+		target := s.cnameTarget(match)
+		if target == "" {
+			return false
+		}
+		m.Answer = append(m.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: match.TTL},
+			Target: target,
+		})
+		if q.Qtype != dns.TypeCNAME && s.config().ChaseCNAME {
+			s.chaseCNAMETarget(ctx, target, q.Qtype, m)
+		}
+		return true
+	}
+	return false
+}
+
+// cnameTarget is the name a matched host without addresses of its own is
+// aliased to, as ingressRecords answers it: its load balancer hostname, or
+// INGRESS_IP when that is a hostname yet to resolve. It is "" for hosts
+// answered with addresses.
+func (s *Server) cnameTarget(match ingressMatch) string {
+	if _, ok := s.config().MaintenanceHosts[match.Name]; ok || len(match.IPs) > 0 {
+		return ""
+	}
+	if match.Hostname != "" {
+		return dns.Fqdn(match.Hostname)
+	}
+	if s.config().IngressHostname != "" && s.ingressHostIPs.Load() == nil {
+		return dns.Fqdn(s.config().IngressHostname)
+	}
+	return ""
+}
+
+// answerIngress appends the records for the ingresses matching name and
+// reports how many matched, or errNoMatch if none did.
+func (s *Server) answerIngress(ctx context.Context, m *dns.Msg, q dns.Question, name string, ingresses []*networkingv1.Ingress) (int, error) {
+	confirmed, err := s.matchName(ingresses, name)
+
+	// A match without an address for this family is answered NOERROR without
+	// records. One without an address in any family is left to
+	// NO_IP_BEHAVIOR, unless another match has one.
+	for _, match := range confirmed {
+		if !s.hasAddress(match) {
+			continue
+		}
+		if match.Wildcard {
+			s.recordWildcardName(ctx, name, match)
+		}
+		for _, record := range s.ingressRecords(q, match) {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				continue
+			}
+			rr.Header().Ttl = match.TTL
+			queryLogger(ctx).Debug("Answer", "name", name, "rr", rr.String())
 			m.Answer = append(m.Answer, rr)
+			if cname, ok := rr.(*dns.CNAME); ok && s.config().ChaseCNAME {
+				s.chaseCNAMETarget(ctx, cname.Target, q.Qtype, m)
+			}
 		}
 	}
+	if err == nil && !slices.ContainsFunc(confirmed, s.hasAddress) {
+		return len(confirmed), errNoAddress
+	}
+	return len(confirmed), err
+}
 
-	if fallbackRequired {
-		queryFallbackDNS(name, m)
+// matchQuestion matches q against the ingresses with the outcome
+// answerQuestion would have, without building any records: PTR questions
+// are matched by address and the zone apex SOA always matches, while A,
+// AAAA and ANY questions for hosts without an address fail with
+// errNoAddress. Only hosts matched by name are returned.
+func (s *Server) matchQuestion(ingresses []*networkingv1.Ingress, q dns.Question, name, zone string) ([]ingressMatch, error) {
+	switch {
+	case q.Qtype == dns.TypePTR:
+		if len(s.matchReverse(ingresses, name)) == 0 {
+			return nil, errNoMatch
+		}
+		return nil, nil
+	case q.Qtype == dns.TypeSOA && zone != "" && dns.CanonicalName(q.Name) == zone:
+		return nil, nil
+	}
+	confirmed, err := s.matchName(ingresses, name)
+	switch q.Qtype {
+	case dns.TypeANY:
+		if s.config().MinimalANY {
+			break
+		}
+		fallthrough
+	case dns.TypeA, dns.TypeAAAA:
+		if err == nil && !slices.ContainsFunc(confirmed, s.hasAddress) {
+			err = errNoAddress
+		}
 	}
+	return confirmed, err
 }
 
-func fetchIngresses() ([]networkingv1.Ingress, error) {
-	list, err := kubeClient.NetworkingV1().Ingresses("").List(context.TODO(), metav1.ListOptions{})
+// answerStatic appends the static host addresses of the queried family.
+// Other types get NODATA.
+func (s *Server) answerStatic(m *dns.Msg, q dns.Question, ips []string) {
+	var records []string
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		records = addressRecords(q, ips)
+	case dns.TypeANY:
+		if s.config().MinimalANY {
+			m.Answer = append(m.Answer, newHINFO(q.Name, s.config().DNSTTL))
+			return
+		}
+		records = append(addressRecords(withQtype(q, dns.TypeA), ips), addressRecords(withQtype(q, dns.TypeAAAA), ips)...)
+	}
+	for _, record := range records {
+		if rr, err := dns.NewRR(record); err == nil {
+			rr.Header().Ttl = s.config().DNSTTL
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+}
+
+func isCNAME(rr dns.RR) bool {
+	return rr.Header().Rrtype == dns.TypeCNAME
+}
+
+func withQtype(q dns.Question, qtype uint16) dns.Question {
+	q.Qtype = qtype
+	return q
+}
+
+// fetchIngresses returns the ingresses from the informer cache. Until the
+// cache has synced it asks the API server directly, so ingress hosts aren't
+// forwarded upstream during startup, and falls back to the SNAPSHOT_PATH
+// snapshot, or else whatever the cache holds, if that fails. A cache gone
+// stale under STALE_BEHAVIOR=servfail is treated as unavailable.
+func (s *Server) fetchIngresses(ctx context.Context) ([]*networkingv1.Ingress, error) {
+	if !s.cacheSynced.Load() && s.kubeClient != nil {
+		ingresses, err := s.listIngresses(ctx)
+		if err == nil {
+			return ingresses, nil
+		}
+		if snapshot := s.snapshot.Load(); snapshot != nil {
+			queryLogger(ctx).Warn("Failed to list ingresses, serving from snapshot", "err", err)
+			return *snapshot, nil
+		}
+		queryLogger(ctx).Warn("Failed to list ingresses, serving from cache", "err", err)
+	}
+	if s.refuseStale() {
+		return nil, fmt.Errorf("%w: cache stale for %s", errAPIUnavailable, s.staleness().Round(time.Second))
+	}
+	ingresses, err := s.cachedIngresses()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", errAPIUnavailable, err)
 	}
-	return list.Items, nil
+	return ingresses, nil
 }
 
-func matchIngress(ingresses []networkingv1.Ingress, name string) ([]string, bool) {
-	var confirmedNames []string
-	fallbackRequired := false
+// cachedIngresses returns the ingresses held by the informer cache.
+func (s *Server) cachedIngresses() ([]*networkingv1.Ingress, error) {
+	var ingresses []*networkingv1.Ingress
+	for _, lister := range s.ingressListers {
+		list, err := lister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		ingresses = append(ingresses, list...)
+	}
+	return ingresses, nil
+}
+
+// listIngresses lists the watched ingresses from the API server, retrying
+// transient failures with a short backoff.
+func (s *Server) listIngresses(ctx context.Context) ([]*networkingv1.Ingress, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config().KubeAPITimeout)
+	defer cancel()
 
+	var ingresses []*networkingv1.Ingress
+	forbidden := 0
+	for _, namespace := range s.watchedNamespaces() {
+		var list *networkingv1.IngressList
+		err := retry.OnError(listBackoff, isTransientError, func() (err error) {
+			list, err = s.kubeClient.NetworkingV1().Ingresses(namespace).List(ctx, metav1.ListOptions{})
+			return err
+		})
+		if apierrors.IsForbidden(err) {
+			queryLogger(ctx).Debug("Not allowed to list ingresses, skipping namespace", "namespace", namespace)
+			forbidden++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			ingresses = append(ingresses, &list.Items[i])
+		}
+	}
+	if forbidden == len(s.watchedNamespaces()) {
+		return nil, fmt.Errorf("not allowed to list ingresses in any of %v", s.watchedNamespaces())
+	}
+	return ingresses, nil
+}
+
+// isTransientError reports whether a failed API call is worth retrying.
+// Authentication and authorization failures are not.
+func isTransientError(err error) bool {
+	return apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err) ||
+		utilnet.IsConnectionRefused(err) ||
+		utilnet.IsConnectionReset(err)
+}
+
+// ingressMatch is a queried name served by an ingress, together with the
+// addresses published in that ingress' load balancer status and the rule it
+// matched. Name is the lowercase FQDN of the query for both exact and
+// wildcard matches; records are built from the query name itself so the
+// client's casing is preserved.
+type ingressMatch struct {
+	Name      string   `json:"name"`
+	IPs       []string `json:"ips,omitempty"`
+	Hostname  string   `json:"hostname,omitempty"`
+	Namespace string   `json:"namespace"`
+	Ingress   string   `json:"ingress,omitempty"`
+	Service   string   `json:"service,omitempty"`
+	Rule      string   `json:"rule"`
+	Wildcard  bool     `json:"wildcard"`
+	TTL       uint32   `json:"ttl"`
+	TXT       []string `json:"txt,omitempty"`
+}
+
+// matchIngress returns the match for name among the ingresses, or
+// errNoMatch.
+func (s *Server) matchIngress(ingresses []*networkingv1.Ingress, name string) ([]ingressMatch, error) {
+	var confirmed []ingressMatch
+	name = dns.CanonicalName(name)
+
+	// Several rules or ingresses, possibly of different controllers, may
+	// declare the same host: their addresses are answered together. An exact
+	// host takes precedence over wildcards.
+	add := func(ingress *networkingv1.Ingress, rule string, wildcard bool) {
+		match := s.newIngressMatch(ingress, name)
+		match.Rule, match.Wildcard = rule, wildcard
+		switch {
+		case len(confirmed) == 0 || confirmed[0].Wildcard && !wildcard:
+			confirmed = []ingressMatch{match}
+		case confirmed[0].Wildcard == wildcard:
+			confirmed[0].merge(match)
+		}
+	}
+
+	var catchAll *networkingv1.Ingress
 	for _, ingress := range ingresses {
-		for _, rule := range ingress.Spec.Rules {
-			if name == rule.Host {
-				confirmedNames = append(confirmedNames, rule.Host)
-			} else if wildcardRegex.MatchString(rule.Host) {
-				matches := wildcardRegex.FindStringSubmatch(rule.Host)
-				domainPattern := matches[1]
-				if matched, _ := regexp.MatchString(domainPattern, name); matched {
-					confirmedNames = append(confirmedNames, name)
+		if !s.matchIngressClass(ingress) || !s.matchIngressAnnotation(ingress) {
+			continue
+		}
+		for _, declared := range s.ingressHosts(ingress) {
+			host := canonicalHost(declared)
+			if host == "" {
+				// A rule without a host catches every request the ingress
+				// controller gets. It is skipped unless MATCH_EMPTY_HOST is
+				// set, and then only answers names no other rule matches.
+				if !s.config().MatchEmptyHost {
+					slog.Debug("Skipping ingress rule without host", "namespace", ingress.Namespace, "ingress", ingress.Name)
+				} else if catchAll == nil {
+					catchAll = ingress
 				}
+				continue
+			}
+			if malformedHost(host) {
+				// A host like "*." would otherwise risk matching every name.
+				s.warnMalformedHost(ingress, declared)
+				continue
 			}
+			if name == host {
+				add(ingress, host, false)
+			} else if s.matchWildcard(host, name) {
+				add(ingress, host, true)
+			}
+		}
+		if pattern, ok := ingress.Annotations[matchAnnotation]; ok && s.matchPattern(pattern, name) {
+			add(ingress, pattern, true)
 		}
 	}
+	if len(confirmed) == 0 && catchAll != nil {
+		add(catchAll, "", true)
+	}
 
-	if len(confirmedNames) == 0 {
-		fallbackRequired = true
+	if len(confirmed) == 0 {
+		return nil, errNoMatch
 	}
+	return confirmed, nil
+}
 
-	return confirmedNames, fallbackRequired
+// servedHosts returns the distinct hosts, wildcards included, that the
+// ingresses passing INGRESS_CLASS and REQUIRE_ANNOTATION declare.
+func (s *Server) servedHosts(ingresses []*networkingv1.Ingress) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, ingress := range ingresses {
+		if !s.matchIngressClass(ingress) || !s.matchIngressAnnotation(ingress) {
+			continue
+		}
+		for _, host := range s.ingressHosts(ingress) {
+			if host := canonicalHost(host); host != "" && !malformedHost(host) {
+				hosts[host] = true
+			}
+		}
+	}
+	return hosts
 }
 
-func queryFallbackDNS(name string, m *dns.Msg) {
-	c := new(dns.Client)
-	msg := new(dns.Msg)
-	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
-	r, _, err := c.Exchange(msg, fallbackDNS)
+// malformedHosts counts the hosts the ingresses declare that are skipped as
+// malformed wildcards.
+func (s *Server) malformedHosts(ingresses []*networkingv1.Ingress) int {
+	count := 0
+	for _, ingress := range ingresses {
+		if !s.matchIngressClass(ingress) || !s.matchIngressAnnotation(ingress) {
+			continue
+		}
+		for _, host := range s.ingressHosts(ingress) {
+			if malformedHost(canonicalHost(host)) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// warnMalformedHost logs a malformed wildcard host the first time it is
+// skipped, rather than on every query that is matched against it.
+func (s *Server) warnMalformedHost(ingress *networkingv1.Ingress, host string) {
+	key := ingress.Namespace + "/" + ingress.Name + "/" + host
+	if _, seen := s.malformedSeen.LoadOrStore(key, true); seen {
+		return
+	}
+	slog.Warn("Skipping malformed wildcard host", "namespace", ingress.Namespace, "ingress", ingress.Name, "host", host)
+}
+
+// ingressHosts returns the hosts of an ingress's rules, empty ones included,
+// followed by its TLS hosts when MATCH_TLS_HOSTS is set.
+func (s *Server) ingressHosts(ingress *networkingv1.Ingress) []string {
+	var hosts []string
+	for _, rule := range ingress.Spec.Rules {
+		hosts = append(hosts, rule.Host)
+	}
+	if s.config().MatchTLSHosts {
+		for _, tls := range ingress.Spec.TLS {
+			for _, host := range tls.Hosts {
+				if strings.TrimSpace(host) != "" {
+					hosts = append(hosts, host)
+				}
+			}
+		}
+	}
+	return hosts
+}
+
+// matchIngressClass reports whether the ingress belongs to the configured
+// INGRESS_CLASS, checking the legacy annotation when the class name is unset.
+// INGRESS_CLASS matches either the class name or the controller of the
+// IngressClass it refers to.
+func (s *Server) matchIngressClass(ingress *networkingv1.Ingress) bool {
+	if s.config().IngressClass == "" {
+		return true
+	}
+	name := ingressClassName(ingress)
+	return name == s.config().IngressClass || s.ingressClassController(name) == s.config().IngressClass
+}
+
+func (s *Server) matchIngressAnnotation(ingress *networkingv1.Ingress) bool {
+	if !s.config().RequireAnnotation {
+		return true
+	}
+	enabled, _ := strconv.ParseBool(ingress.Annotations[enabledAnnotation])
+	return enabled
+}
+
+func (s *Server) newIngressMatch(ingress *networkingv1.Ingress, name string) ingressMatch {
+	match := ingressMatch{
+		Name:      dns.Fqdn(name),
+		Namespace: ingress.Namespace,
+		Ingress:   ingress.Name,
+		TTL:       s.annotatedTTL(ingress.Annotations),
+		TXT:       annotatedTXT(ingress.Annotations),
+	}
+	for _, lb := range ingress.Status.LoadBalancer.Ingress {
+		if lb.IP != "" {
+			match.IPs = append(match.IPs, lb.IP)
+		} else if lb.Hostname != "" && match.Hostname == "" {
+			match.Hostname = lb.Hostname
+		}
+	}
+	return match
+}
+
+// merge adds the addresses of another match for the same name. The lowest
+// TTL wins so no record outlives its source.
+func (m *ingressMatch) merge(other ingressMatch) {
+	for _, ip := range other.IPs {
+		if !slices.Contains(m.IPs, ip) {
+			m.IPs = append(m.IPs, ip)
+		}
+	}
+	if m.Hostname == "" {
+		m.Hostname = other.Hostname
+	}
+	for _, text := range other.TXT {
+		if !slices.Contains(m.TXT, text) {
+			m.TXT = append(m.TXT, text)
+		}
+	}
+	m.TTL = min(m.TTL, other.TTL)
+}
+
+// annotatedTTL returns the ttlAnnotation value, or DNS_TTL when it is
+// missing or not a number of seconds.
+func (s *Server) annotatedTTL(annotations map[string]string) uint32 {
+	value, ok := annotations[ttlAnnotation]
+	if !ok {
+		return s.config().DNSTTL
+	}
+	ttl, err := strconv.ParseUint(value, 10, 32)
 	if err != nil {
-		log.Printf("Fallback DNS query failed: %v\n", err)
+		slog.Debug("Ignoring invalid TTL annotation", "value", value, "err", err)
+		return s.config().DNSTTL
+	}
+	return uint32(ttl)
+}
+
+// ingressRecords builds the answers for a matched host, preferring the
+// addresses from the ingress status and falling back to INGRESS_IP /
+// INGRESS_IPV6. A MAINTENANCE_HOSTS entry for the host overrides both. It
+// returns nothing when there is no address for the query type.
+func (s *Server) ingressRecords(q dns.Question, match ingressMatch) []string {
+	if ips, ok := s.config().MaintenanceHosts[match.Name]; ok {
+		return s.rotateRecords(addressRecords(q, ips))
+	}
+	if records := addressRecords(q, match.IPs); len(records) > 0 {
+		return s.rotateRecords(records)
+	}
+
+	if match.Hostname != "" {
+		return []string{fmt.Sprintf("%s CNAME %s", q.Name, dns.Fqdn(match.Hostname))}
+	}
+	if s.config().IngressHostname != "" {
+		if ips := s.ingressHostIPs.Load(); ips != nil {
+			return s.rotateRecords(addressRecords(q, *ips))
+		}
+		return []string{fmt.Sprintf("%s CNAME %s", q.Name, s.config().IngressHostname)}
+	}
+
+	switch q.Qtype {
+	case dns.TypeA:
+		return s.ingressIPRecords(q, s.config().IngressIPs)
+	case dns.TypeAAAA:
+		return s.ingressIPRecords(q, s.config().IngressIPv6s)
+	}
+	return nil
+}
+
+// ingressIPRecords answers with the INGRESS_IP or INGRESS_IPV6 addresses,
+// in an order drawn by their weights when they have any.
+func (s *Server) ingressIPRecords(q dns.Question, ips []string) []string {
+	if weights := s.config().IngressIPWeights; weights != nil {
+		return addressRecords(q, weightedOrder(ips, weights))
+	}
+	return s.rotateRecords(addressRecords(q, ips))
+}
+
+// addressRecords formats an A or AAAA record for each address of the family
+// asked for by q.
+func addressRecords(q dns.Question, ips []string) []string {
+	var records []string
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		switch {
+		case parsed == nil:
+			continue
+		case q.Qtype == dns.TypeA && parsed.To4() != nil:
+			records = append(records, fmt.Sprintf("%s A %s", q.Name, ip))
+		case q.Qtype == dns.TypeAAAA && parsed.To4() == nil:
+			records = append(records, fmt.Sprintf("%s AAAA %s", q.Name, ip))
+		}
+	}
+	return records
+}
+
+// rotateRecords shifts the records by one position per call when
+// ROTATE_INGRESS_IPS is set, for simple client-side load balancing.
+func (s *Server) rotateRecords(records []string) []string {
+	if !s.config().RotateIngressIPs || len(records) < 2 {
+		return records
+	}
+	offset := int(s.rotation.Add(1) % uint64(len(records)))
+	return append(records[offset:], records[:offset]...)
+}
+
+// weightedOrder returns ips in a random order in which each address is
+// picked for the next position with a probability proportional to its
+// weight among those left. Clients mostly use the first address, so this
+// spreads them roughly by weight.
+func weightedOrder(ips []string, weights map[string]int) []string {
+	weightOf := func(ip string) int {
+		if weight, ok := weights[ip]; ok {
+			return weight
+		}
+		return 1
+	}
+
+	remaining := slices.Clone(ips)
+	ordered := make([]string, 0, len(ips))
+	for len(remaining) > 0 {
+		total := 0
+		for _, ip := range remaining {
+			total += weightOf(ip)
+		}
+		pick := rand.IntN(total)
+		for i, ip := range remaining {
+			if pick -= weightOf(ip); pick < 0 {
+				ordered = append(ordered, ip)
+				remaining = slices.Delete(remaining, i, i+1)
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+// annotatedTXT returns the non-empty lines of the txtAnnotation.
+func annotatedTXT(annotations map[string]string) []string {
+	var texts []string
+	for _, line := range strings.Split(annotations[txtAnnotation], "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			texts = append(texts, line)
+		}
+	}
+	return texts
+}
+
+// newTXT builds a TXT record for text, split into the 255 byte strings a
+// TXT record is made of.
+func newTXT(name string, ttl uint32, text string) dns.RR {
+	txt := &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl}}
+	for len(text) > 255 {
+		txt.Txt = append(txt.Txt, text[:255])
+		text = text[255:]
+	}
+	txt.Txt = append(txt.Txt, text)
+	return txt
+}
+
+// newHINFO builds the synthesized HINFO record RFC 8482 answers ANY
+// queries with.
+func newHINFO(name string, ttl uint32) dns.RR {
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: ttl},
+		Cpu: "RFC8482",
+	}
+}
+
+// canonicalHost lowercases a host from an ingress rule or annotation and
+// makes it fully qualified, so "Example.com" and "example.com." compare
+// equal to the query name. Empty hosts stay empty.
+func canonicalHost(host string) string {
+	host = strings.TrimSpace(host)
+	if host == "" {
+		return ""
+	}
+	return dns.CanonicalName(host)
+}
+
+// malformedHost reports whether a canonical host is a wildcard without a
+// usable domain, such as "*." or "*..".
+func malformedHost(host string) bool {
+	return strings.Contains(host, "*") && wildcardDomain(host) == ""
+}
+
+// matchWildcard matches a canonical query name against a canonical
+// wildcard host. As in RFC 4592, *.example.com matches a.example.com but
+// neither example.com itself, unless WILDCARD_INCLUDES_APEX is set, nor
+// a.b.example.com, unless WILDCARD_MULTILEVEL is set.
+func (s *Server) matchWildcard(host, name string) bool {
+	domain := wildcardDomain(host)
+	if domain == "" {
+		return false
+	}
+	if name == domain {
+		return s.config().WildcardIncludesApex
+	}
+
+	prefix, found := strings.CutSuffix(name, "."+domain)
+	if !found || prefix == "" {
+		return false
+	}
+	return s.config().WildcardMultiLevel || !strings.Contains(prefix, ".")
+}
+
+// wildcardDomain returns the domain a canonical wildcard host covers, or ""
+// if host isn't a wildcard or covers no proper domain, such as "*.." or
+// "*.a..b.".
+func wildcardDomain(host string) string {
+	matches := wildcardRegex.FindStringSubmatch(host)
+	if matches == nil || matches[1] == "." {
+		return ""
+	}
+	if _, ok := dns.IsDomainName(matches[1]); !ok {
+		return ""
+	}
+	return matches[1]
+}
+
+// matchPattern matches a canonical query name, without the trailing dot,
+// against a matchAnnotation regular expression, which must match the whole
+// name. Patterns are compiled once and cached; Go's regexp engine runs in
+// linear time, so a pattern can't blow up on a crafted name, but overlong
+// patterns are rejected anyway.
+func (s *Server) matchPattern(pattern, name string) bool {
+	v, ok := s.matchPatterns.Load(pattern)
+	if !ok {
+		var re *regexp.Regexp
+		if len(pattern) <= maxMatchPattern {
+			var err error
+			if re, err = regexp.Compile(`(?i)^(?:` + pattern + `)$`); err != nil {
+				slog.Warn("Ignoring invalid match annotation", "pattern", pattern, "err", err)
+			}
+		} else {
+			slog.Warn("Ignoring overlong match annotation", "pattern", pattern, "max", maxMatchPattern)
+		}
+		v, _ = s.matchPatterns.LoadOrStore(pattern, re)
+	}
+	re := v.(*regexp.Regexp)
+	return re != nil && re.MatchString(strings.TrimSuffix(name, "."))
+}
+
+func (s *Server) queryFallbackDNS(ctx context.Context, name string, qtype uint16, m *dns.Msg) {
+	fallbackQueriesTotal.Inc()
+	r := s.exchangeFallback(ctx, name, qtype)
+	if r == nil {
+		fallbackFailuresTotal.Inc()
+		m.Rcode = dns.RcodeServerFailure
 		return
 	}
+
+	// Forwarded answers are never authoritative, but the upstream rcode and
+	// authority section are passed through so an NXDOMAIN stays an NXDOMAIN
+	// and can be negatively cached by the client.
+	m.Authoritative = false
+	m.RecursionAvailable = true
+	m.Rcode = r.Rcode
 	for _, ans := range r.Answer {
-		log.Printf("Answer: %v\n", ans.String())
+		queryLogger(ctx).Debug("Answer", "name", name, "rr", ans.String())
 		m.Answer = append(m.Answer, ans)
 	}
+	m.Ns = append(m.Ns, r.Ns...)
+	for _, extra := range r.Extra {
+		if _, isOPT := extra.(*dns.OPT); !isOPT {
+			m.Extra = append(m.Extra, extra) // Our own OPT is added by the handler
+		}
+	}
+}
+
+// mergesFallback reports whether, with MERGE_FALLBACK, the upstream records
+// of qtype are added to those of the matched host name. Address, reverse and
+// SOA records always come from the ingresses alone.
+func (s *Server) mergesFallback(name string, qtype uint16) bool {
+	if !s.config().MergeFallback || s.config().DisableFallback || len(s.upstreamServers(name)) == 0 {
+		return false
+	}
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeANY, dns.TypePTR, dns.TypeSOA:
+		return false
+	}
+	return true
 }
 
-func getEnv(key, fallback string) string {
-	if value, exists := os.LookupEnv(key); exists {
-		return value
+// mergeFallbackDNS adds the upstream answer for a matched host to m. The
+// host exists, so an upstream failure or NXDOMAIN leaves m as it is.
+func (s *Server) mergeFallbackDNS(ctx context.Context, name string, qtype uint16, m *dns.Msg) {
+	fallbackQueriesTotal.Inc()
+	r := s.exchangeFallback(ctx, name, qtype)
+	if r == nil {
+		fallbackFailuresTotal.Inc()
+		return
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return
+	}
+	m.RecursionAvailable = true
+	m.Answer = dns.Dedup(append(m.Answer, r.Answer...), nil)
+}
+
+// chaseCNAMETarget appends the upstream records for a synthesized CNAME's
+// target so clients don't need a second lookup. The target is answered from
+// the response cache when it can be, and nothing is forwarded when fallback
+// is disabled. The records go after the CNAME, so a UDP reply too large for
+// the client loses them before the CNAME itself.
+func (s *Server) chaseCNAMETarget(ctx context.Context, target string, qtype uint16, m *dns.Msg) {
+	q := dns.Question{Name: dns.Fqdn(target), Qtype: qtype, Qclass: dns.ClassINET}
+	subnet := clientSubnetFrom(ctx) != nil
+	if r, ok := s.responses.get(q); ok && !subnet {
+		m.Answer = append(m.Answer, r.Answer...)
+		return
+	}
+	if s.config().DisableFallback {
+		return
+	}
+	r := s.exchangeFallback(ctx, target, qtype)
+	if r == nil {
+		return
+	}
+	for _, ans := range r.Answer {
+		queryLogger(ctx).Debug("Answer", "name", target, "rr", ans.String())
+		m.Answer = append(m.Answer, ans)
+	}
+	if !subnet && r.Rcode == dns.RcodeSuccess {
+		s.responses.set(q, r.Answer, true)
+	}
+}
+
+// exchangeFallback forwards the question upstream, collapsing concurrent
+// identical questions into a single exchange whose response they share.
+// It returns nil without waiting for the exchange once ctx is done.
+//
+// The shared exchange belongs to no single query: it isn't cancelled with
+// the query that started it, but bounded by FALLBACK_TIMEOUT for each
+// server it may try, and logs without that query's ID.
+func (s *Server) exchangeFallback(ctx context.Context, name string, qtype uint16) *dns.Msg {
+	key := dns.CanonicalName(name) + "/" + dns.Type(qtype).String()
+	if ecs := clientSubnetFrom(ctx); ecs != nil {
+		key += "/" + ecs.String()
+	}
+	ch := s.fallbackGroup.DoChan(key, func() (any, error) {
+		timeout := s.config().FallbackTimeout * time.Duration(max(len(s.upstreamServers(name)), 1))
+		shared, cancel := context.WithTimeout(withSharedLogger(ctx, key), timeout)
+		defer cancel()
+		return s.exchangeUpstream(shared, name, qtype), nil
+	})
+	select {
+	case res := <-ch:
+		r := res.Val.(*dns.Msg)
+		if res.Shared && r != nil {
+			r = r.Copy()
+		}
+		return r
+	case <-ctx.Done():
+		queryLogger(ctx).Debug("Fallback DNS query abandoned", "name", name, "err", ctx.Err())
+		return nil
+	}
+}
+
+// upstreamServers returns the servers name is forwarded to: those of the
+// longest ZONE_FORWARDERS zone containing it, or FALLBACK_DNS.
+func (s *Server) upstreamServers(name string) []string {
+	if len(s.config().ZoneForwarders) > 0 {
+		fqdn := dns.CanonicalName(name)
+		for off, end := 0, false; !end; off, end = dns.NextLabel(fqdn, off) {
+			if servers, ok := s.config().ZoneForwarders[fqdn[off:]]; ok {
+				return servers
+			}
+		}
+	}
+	return s.config().FallbackDNS
+}
+
+// exchangeUpstream sends the question to the upstream servers for name and
+// returns the first usable response, or nil if all of them failed. The
+// servers are tried in order, or all at once with FALLBACK_STRATEGY=fastest.
+func (s *Server) exchangeUpstream(ctx context.Context, name string, qtype uint16) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	if ecs := clientSubnetFrom(ctx); ecs != nil {
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+		opt := msg.IsEdns0()
+		opt.Option = append(opt.Option, ecs)
+	}
+
+	servers := s.upstreamServers(name)
+	var r *dns.Msg
+	if s.config().FallbackStrategy == "fastest" {
+		r = s.exchangeFastest(ctx, msg, servers)
+	} else {
+		for _, server := range servers {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if resp, err := s.exchangeServer(ctx, msg, server); err == nil {
+				r = resp
+				break
+			}
+		}
+	}
+	if r == nil && ctx.Err() == nil {
+		queryLogger(ctx).Warn("All fallback DNS servers failed", "name", name, "servers", servers)
+	}
+	return r
+}
+
+// exchangeFastest sends msg to every server concurrently and returns the
+// first usable response, cancelling the other exchanges.
+func (s *Server) exchangeFastest(ctx context.Context, msg *dns.Msg, servers []string) *dns.Msg {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	responses := make(chan *dns.Msg, len(servers))
+	for _, server := range servers {
+		go func(server string) {
+			resp, err := s.exchangeServer(ctx, msg.Copy(), server)
+			if err != nil {
+				resp = nil
+			}
+			responses <- resp
+		}(server)
+	}
+	for range servers {
+		if resp := <-responses; resp != nil {
+			return resp
+		}
+	}
+	return nil
+}
+
+// exchangeServer sends msg to a single fallback server, retrying over TCP
+// if the UDP response was truncated. SERVFAIL and REFUSED are errors, so
+// the next server gets a chance.
+func (s *Server) exchangeServer(ctx context.Context, msg *dns.Msg, server string) (*dns.Msg, error) {
+	name := msg.Question[0].Name
+	c := &dns.Client{Net: s.config().FallbackNet, Timeout: s.config().FallbackTimeout}
+	resp, rtt, err := s.exchangeClient(ctx, c, msg, server)
+	if err == nil && resp.Truncated && c.Net == "udp" {
+		queryLogger(ctx).Debug("Fallback DNS response truncated, retrying over TCP", "name", name, "server", server)
+		tcp := &dns.Client{Net: "tcp", Timeout: s.config().FallbackTimeout}
+		resp, rtt, err = s.exchangeClient(ctx, tcp, msg, server)
+	}
+	if err != nil {
+		queryLogger(ctx).Debug("Fallback DNS query failed", "name", name, "server", server, "err", err)
+		return nil, err
+	}
+	fallbackRTT.WithLabelValues(server).Observe(rtt.Seconds())
+	queryLogger(ctx).Debug("Fallback DNS response", "name", name, "server", server, "rcode", dns.RcodeToString[resp.Rcode], "rtt", rtt)
+	if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+		return nil, fmt.Errorf("%s answered %s", server, dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// exchangeClient sends msg to server with c. UDP exchanges use a socket of
+// their own; TCP and DNS-over-TLS ones reuse a pooled connection when there
+// is one, redialling once if the server has closed it in the meantime.
+func (s *Server) exchangeClient(ctx context.Context, c *dns.Client, msg *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	if c.Net == "udp" {
+		return c.ExchangeContext(ctx, msg, server)
+	}
+
+	key := c.Net + "/" + server
+	if conn := s.conns.get(key); conn != nil {
+		resp, rtt, err := c.ExchangeWithConnContext(ctx, msg, conn)
+		if err == nil {
+			s.conns.put(key, conn)
+			return resp, rtt, nil
+		}
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, rtt, err
+		}
+	}
+
+	conn, err := c.DialContext(ctx, server)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, rtt, err := c.ExchangeWithConnContext(ctx, msg, conn)
+	if err != nil {
+		conn.Close()
+		return nil, rtt, err
 	}
-	return fallback
+	s.conns.put(key, conn)
+	return resp, rtt, nil
 }
@@ -0,0 +1,2304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+// TestMain keeps the query log of the tests out of their output.
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testEnv is the environment every test server starts from. Fallback is
+// disabled so no test reaches a real resolver unless it points FALLBACK_DNS
+// at a fake upstream.
+var testEnv = map[string]string{
+	"INGRESS_IP":       "10.0.0.1",
+	"DISABLE_FALLBACK": "true",
+}
+
+// newTestServer builds a Server from testEnv overridden by env, answering
+// from a lister holding ingresses.
+func newTestServer(t testing.TB, env map[string]string, ingresses ...*networkingv1.Ingress) *Server {
+	t.Helper()
+	s := newServer(testConfig(t, env), nil)
+	s.ingressListers = []networkinglisters.IngressLister{networkinglisters.NewIngressLister(newIndexer(t, ingresses...))}
+	s.cacheSynced.Store(true)
+	return s
+}
+
+// testConfig loads the configuration of testEnv overridden by env.
+func testConfig(t testing.TB, env map[string]string) *Config {
+	t.Helper()
+	for key, value := range testEnv {
+		if _, ok := env[key]; !ok {
+			t.Setenv(key, value)
+		}
+	}
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return cfg
+}
+
+// newIndexer returns an informer-style indexer holding objects.
+func newIndexer[T runtime.Object](t testing.TB, objects ...T) cache.Indexer {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, object := range objects {
+		if err := indexer.Add(object); err != nil {
+			t.Fatalf("adding %v: %v", object, err)
+		}
+	}
+	return indexer
+}
+
+// newIngress builds an ingress in the default namespace with a rule for
+// each host.
+func newIngress(name string, hosts ...string) *networkingv1.Ingress {
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+	}
+	for _, host := range hosts {
+		ingress.Spec.Rules = append(ingress.Spec.Rules, networkingv1.IngressRule{Host: host})
+	}
+	return ingress
+}
+
+// withStatus sets the load balancer status of ingress to addresses, each
+// either an IP or a hostname.
+func withStatus(ingress *networkingv1.Ingress, addresses ...string) *networkingv1.Ingress {
+	for _, address := range addresses {
+		lb := networkingv1.IngressLoadBalancerIngress{IP: address}
+		if net.ParseIP(address) == nil {
+			lb = networkingv1.IngressLoadBalancerIngress{Hostname: address}
+		}
+		ingress.Status.LoadBalancer.Ingress = append(ingress.Status.LoadBalancer.Ingress, lb)
+	}
+	return ingress
+}
+
+// udpClient is the address test queries come from, unless they say
+// otherwise.
+var udpClient = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 5353}
+
+// testWriter is a dns.ResponseWriter recording the replies written to it.
+type testWriter struct {
+	remote net.Addr
+	msg    *dns.Msg // the last reply
+	msgs   []*dns.Msg
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *testWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+func (w *testWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+func (w *testWriter) Close() error        { return nil }
+func (w *testWriter) TsigStatus() error   { return nil }
+func (w *testWriter) TsigTimersOnly(bool) {}
+func (w *testWriter) Hijack()             {}
+
+// query asks s a single question over UDP and returns the reply.
+func query(t testing.TB, s *Server, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	return exchange(t, s, req, udpClient)
+}
+
+// exchange passes req to the handler as if it came from remote and returns
+// the reply.
+func exchange(t testing.TB, s *Server, req *dns.Msg, remote net.Addr) *dns.Msg {
+	t.Helper()
+	w := &testWriter{remote: remote}
+	s.handleDNSRequest(w, req)
+	if w.msg == nil {
+		t.Fatalf("no reply to %v", req.Question)
+	}
+	return w.msg
+}
+
+// rdata lists the type and data of each record, like "A 10.0.0.1", to
+// compare answers without their owner names and TTLs.
+func rdata(rrs []dns.RR) []string {
+	var out []string
+	for _, rr := range rrs {
+		data := strings.TrimPrefix(rr.String(), rr.Header().String())
+		out = append(out, dns.Type(rr.Header().Rrtype).String()+" "+data)
+	}
+	return out
+}
+
+func TestAddressQueries(t *testing.T) {
+	ingresses := []*networkingv1.Ingress{
+		newIngress("default-ip", "app.example.com"),
+		withStatus(newIngress("dual-stack", "dual.example.com"), "10.0.0.2", "2001:db8::2"),
+		withStatus(newIngress("v6-only", "v6.example.com"), "2001:db8::3"),
+	}
+	tests := []struct {
+		name   string
+		env    map[string]string
+		host   string
+		qtype  uint16
+		answer []string
+	}{
+		{"A from INGRESS_IP", nil, "app.example.com", dns.TypeA, []string{"A 10.0.0.1"}},
+		{"AAAA without INGRESS_IPV6", nil, "app.example.com", dns.TypeAAAA, nil},
+		{"AAAA from INGRESS_IPV6", map[string]string{"INGRESS_IPV6": "2001:db8::1"}, "app.example.com", dns.TypeAAAA, []string{"AAAA 2001:db8::1"}},
+		{"A from status", nil, "dual.example.com", dns.TypeA, []string{"A 10.0.0.2"}},
+		{"AAAA from status", nil, "dual.example.com", dns.TypeAAAA, []string{"AAAA 2001:db8::2"}},
+		{"AAAA for IPv6-only status", nil, "v6.example.com", dns.TypeAAAA, []string{"AAAA 2001:db8::3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.env, ingresses...)
+			r := query(t, s, tt.host, tt.qtype)
+			if r.Rcode != dns.RcodeSuccess {
+				t.Fatalf("rcode = %s, want NOERROR", dns.RcodeToString[r.Rcode])
+			}
+			if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+		})
+	}
+}
+
+// newInformerServer builds a Server from testEnv overridden by env that
+// watches client through the informers, as main does.
+func newInformerServer(t testing.TB, env map[string]string, client kubernetes.Interface) *Server {
+	t.Helper()
+	s := newServer(testConfig(t, env), client)
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	s.initIngressInformer(stopCh)
+	return s
+}
+
+// waitFor polls cond until it holds, failing the test if it doesn't within
+// a few seconds.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInformerTracksIngresses(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	s := newInformerServer(t, nil, client)
+	if !s.cacheSynced.Load() {
+		t.Fatal("cache not synced after initIngressInformer")
+	}
+	if r := query(t, s, "app.example.com", dns.TypeA); r.Rcode != dns.RcodeNameError {
+		t.Fatalf("rcode before add = %s, want NXDOMAIN", dns.RcodeToString[r.Rcode])
+	}
+
+	ingresses := client.NetworkingV1().Ingresses("default")
+	ingress := withStatus(newIngress("app", "app.example.com"), "10.0.0.2")
+	if _, err := ingresses.Create(context.Background(), ingress, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("creating ingress: %v", err)
+	}
+	waitFor(t, "the ingress to be served", func() bool {
+		return slices.Equal(rdata(query(t, s, "app.example.com", dns.TypeA).Answer), []string{"A 10.0.0.2"})
+	})
+
+	if err := ingresses.Delete(context.Background(), "app", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("deleting ingress: %v", err)
+	}
+	waitFor(t, "the ingress to be dropped", func() bool {
+		return query(t, s, "app.example.com", dns.TypeA).Rcode == dns.RcodeNameError
+	})
+}
+
+func TestWildcardMatching(t *testing.T) {
+	tests := []struct {
+		name       string
+		multiLevel bool
+		want       bool
+	}{
+		{"foo.example.com", false, true},
+		{"example.com", false, false},
+		{"a.b.example.com", false, false},
+		{"a.b.example.com", true, true},
+		{"exampleXcom", false, false},
+		{"fooexample.com", false, false},
+		{"foo.example.com.evil.org", false, false},
+	}
+	ingress := newIngress("wildcard", "*.example.com")
+	for _, tt := range tests {
+		t.Run(tt.name+"/multilevel="+strconv.FormatBool(tt.multiLevel), func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"WILDCARD_MULTILEVEL": strconv.FormatBool(tt.multiLevel)})
+			_, err := s.matchIngress([]*networkingv1.Ingress{ingress}, tt.name)
+			if got := err == nil; got != tt.want {
+				t.Errorf("matched = %t (err %v), want %t", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		ingress *networkingv1.Ingress
+		answer  []string
+	}{
+		{"IP", withStatus(newIngress("ip", "app.example.com"), "10.0.0.2"), []string{"A 10.0.0.2"}},
+		{"several IPs", withStatus(newIngress("ips", "app.example.com"), "10.0.0.2", "10.0.0.3"), []string{"A 10.0.0.2", "A 10.0.0.3"}},
+		{"hostname", withStatus(newIngress("hostname", "app.example.com"), "lb.example.net"), []string{"CNAME lb.example.net."}},
+		{"IP before hostname", withStatus(newIngress("both", "app.example.com"), "lb.example.net", "10.0.0.2"), []string{"A 10.0.0.2"}},
+		{"no status", newIngress("pending", "app.example.com"), []string{"A 10.0.0.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil, tt.ingress)
+			r := query(t, s, "app.example.com", dns.TypeA)
+			if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+		})
+	}
+}
+
+// startUpstream serves handler on a local port, over both UDP and TCP, and
+// returns its address for FALLBACK_DNS.
+func startUpstream(t testing.TB, handler dns.HandlerFunc) string {
+	t.Helper()
+	return serveDNS(t, "127.0.0.1:0", handler)
+}
+
+// serveDNS serves handler over both UDP and TCP on the same port of addr,
+// an ephemeral one for port 0, until the test ends, and returns the address.
+func serveDNS(t testing.TB, addr string, handler dns.Handler) string {
+	t.Helper()
+	var pc net.PacketConn
+	var l net.Listener
+	// The TCP side of the ephemeral UDP port may already be taken, so try a
+	// few ports.
+	for attempt := 0; l == nil; attempt++ {
+		var err error
+		if pc, err = net.ListenPacket("udp", addr); err != nil {
+			t.Fatalf("listening on UDP: %v", err)
+		}
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err != nil {
+			pc.Close()
+			if attempt == 10 {
+				t.Fatalf("listening on TCP: %v", err)
+			}
+		}
+	}
+	for _, server := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: l, Handler: handler}} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go server.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { server.Shutdown() })
+	}
+	return pc.LocalAddr().String()
+}
+
+// answerWith is an upstream handler answering every question with records
+// like "A 192.0.2.1" owned by the queried name, with a TTL of 300.
+func answerWith(records ...string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, record := range records {
+			rr, err := dns.NewRR(r.Question[0].Name + " 300 IN " + record)
+			if err != nil {
+				panic(err)
+			}
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	}
+}
+
+// fallbackEnv enables fallback to servers.
+func fallbackEnv(servers ...string) map[string]string {
+	return map[string]string{"DISABLE_FALLBACK": "false", "FALLBACK_DNS": strings.Join(servers, ",")}
+}
+
+func TestRecordTTL(t *testing.T) {
+	env := fallbackEnv(startUpstream(t, answerWith("A 192.0.2.1")))
+	env["DNS_TTL"] = "120"
+	s := newTestServer(t, env, newIngress("app", "app.example.com"))
+
+	tests := []struct {
+		host string
+		ttl  uint32
+	}{
+		{"app.example.com", 120},
+		{"forwarded.example.org", 300},
+	}
+	for _, tt := range tests {
+		r := query(t, s, tt.host, dns.TypeA)
+		if len(r.Answer) != 1 {
+			t.Fatalf("%s: answer = %q, want one record", tt.host, rdata(r.Answer))
+		}
+		if ttl := r.Answer[0].Header().Ttl; ttl != tt.ttl {
+			t.Errorf("%s: TTL = %d, want %d", tt.host, ttl, tt.ttl)
+		}
+	}
+}
+
+// rcodeWith is an upstream handler answering every question with rcode.
+func rcodeWith(rcode int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		w.WriteMsg(m)
+	}
+}
+
+// silentUpstream returns the address of a UDP socket that never answers.
+func silentUpstream(t testing.TB) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening on UDP: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc.LocalAddr().String()
+}
+
+func TestFallbackFailover(t *testing.T) {
+	working := startUpstream(t, answerWith("A 192.0.2.1"))
+	tests := []struct {
+		name    string
+		servers []string
+		rcode   int
+		answer  []string
+	}{
+		{"first answers", []string{working, silentUpstream(t)}, dns.RcodeSuccess, []string{"A 192.0.2.1"}},
+		{"first fails", []string{startUpstream(t, rcodeWith(dns.RcodeServerFailure)), working}, dns.RcodeSuccess, []string{"A 192.0.2.1"}},
+		{"first refuses", []string{startUpstream(t, rcodeWith(dns.RcodeRefused)), working}, dns.RcodeSuccess, []string{"A 192.0.2.1"}},
+		{"first times out", []string{silentUpstream(t), working}, dns.RcodeSuccess, []string{"A 192.0.2.1"}},
+		{"all fail", []string{silentUpstream(t), startUpstream(t, rcodeWith(dns.RcodeServerFailure))}, dns.RcodeServerFailure, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := fallbackEnv(tt.servers...)
+			env["FALLBACK_TIMEOUT"] = "100ms"
+			s := newTestServer(t, env)
+			r := query(t, s, "forwarded.example.org", dns.TypeA)
+			if r.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening on UDP: %v", err)
+	}
+	started := make(chan struct{})
+	dnsServer := &dns.Server{PacketConn: pc, Handler: answerWith(), NotifyStartedFunc: func() { close(started) }}
+	dnsDone := make(chan error, 1)
+	go func() { dnsDone <- dnsServer.ActivateAndServe() }()
+	<-started
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening on TCP: %v", err)
+	}
+	httpServer := &http.Server{Handler: http.NotFoundHandler()}
+	httpDone := make(chan error, 1)
+	go func() { httpDone <- httpServer.Serve(l) }()
+
+	stopCh := make(chan struct{})
+	shutdown(time.Second, []*dns.Server{dnsServer}, []*http.Server{httpServer}, stopCh)
+
+	select {
+	case <-stopCh:
+	default:
+		t.Error("stop channel still open after shutdown")
+	}
+	for name, done := range map[string]chan error{"DNS": dnsDone, "HTTP": httpDone} {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("%s server still serving after shutdown", name)
+		}
+	}
+}
+
+// handleFanOut answers each question in its own goroutine, as
+// handleDNSRequest did before questions were answered one after another,
+// for BenchmarkHandleDNSRequest to compare against.
+func (s *Server) handleFanOut(w dns.ResponseWriter, r *dns.Msg) {
+	ctx, cancel := s.queryContext()
+	defer cancel()
+
+	msg := dns.Msg{}
+	msg.SetReply(r)
+	msg.Question = r.Question
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, q := range msg.Question {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply := new(dns.Msg)
+			s.processQuery(ctx, reply, q)
+			mu.Lock()
+			mergeReply(&msg, reply)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	w.WriteMsg(&msg)
+}
+
+func BenchmarkHandleDNSRequest(b *testing.B) {
+	var ingresses []*networkingv1.Ingress
+	for i := range 1000 {
+		ingresses = append(ingresses, withStatus(newIngress(fmt.Sprint("app-", i), fmt.Sprintf("app-%d.example.com", i)), "10.0.0.2"))
+	}
+	s := newTestServer(b, map[string]string{"CACHE_SIZE": "0"}, ingresses...)
+
+	handlers := []struct {
+		name    string
+		handler dns.HandlerFunc
+	}{
+		{"sequential", s.handleDNSRequest},
+		{"fan-out", s.handleFanOut},
+	}
+	for _, questions := range []int{1, 4} {
+		req := new(dns.Msg)
+		for i := range questions {
+			req.Question = append(req.Question, dns.Question{Name: fmt.Sprintf("app-%d.example.com.", 500+i), Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		}
+		for _, h := range handlers {
+			b.Run(fmt.Sprintf("%s/questions=%d", h.name, questions), func(b *testing.B) {
+				b.ReportAllocs()
+				for range b.N {
+					h.handler(&testWriter{remote: udpClient}, req)
+				}
+			})
+		}
+	}
+}
+
+func TestWatchNamespaces(t *testing.T) {
+	allowed := withStatus(newIngress("allowed", "allowed.example.com"), "10.0.0.2")
+	allowed.Namespace = "team-a"
+	excluded := withStatus(newIngress("excluded", "excluded.example.com"), "10.0.0.3")
+	excluded.Namespace = "team-b"
+	env := map[string]string{"WATCH_NAMESPACES": "team-a"}
+
+	paths := map[string]func(t *testing.T) *Server{
+		"informer": func(t *testing.T) *Server {
+			return newInformerServer(t, env, fake.NewSimpleClientset(allowed, excluded))
+		},
+		"list before sync": func(t *testing.T) *Server {
+			return newServer(testConfig(t, env), fake.NewSimpleClientset(allowed, excluded))
+		},
+	}
+	for name, build := range paths {
+		t.Run(name, func(t *testing.T) {
+			s := build(t)
+			if r := query(t, s, "allowed.example.com", dns.TypeA); !slices.Equal(rdata(r.Answer), []string{"A 10.0.0.2"}) {
+				t.Errorf("allowed namespace: answer = %q, want [A 10.0.0.2]", rdata(r.Answer))
+			}
+			if r := query(t, s, "excluded.example.com", dns.TypeA); r.Rcode != dns.RcodeNameError {
+				t.Errorf("excluded namespace: rcode = %s, want NXDOMAIN", dns.RcodeToString[r.Rcode])
+			}
+		})
+	}
+}
+
+// withClass sets the IngressClassName of ingress.
+func withClass(ingress *networkingv1.Ingress, class string) *networkingv1.Ingress {
+	ingress.Spec.IngressClassName = &class
+	return ingress
+}
+
+func TestIngressClassFilter(t *testing.T) {
+	legacy := withStatus(newIngress("legacy", "legacy.example.com"), "10.0.0.4")
+	legacy.Annotations = map[string]string{legacyClassAnnotation: "internal"}
+	ingresses := []*networkingv1.Ingress{
+		withClass(withStatus(newIngress("internal", "internal.example.com"), "10.0.0.2"), "internal"),
+		withClass(withStatus(newIngress("public", "public.example.com"), "10.0.0.3"), "public"),
+		legacy,
+		withStatus(newIngress("unclassed", "unclassed.example.com"), "10.0.0.5"),
+	}
+	tests := []struct {
+		class  string
+		served []string
+	}{
+		{"", []string{"internal.example.com", "public.example.com", "legacy.example.com", "unclassed.example.com"}},
+		{"internal", []string{"internal.example.com", "legacy.example.com"}},
+		{"public", []string{"public.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run("class="+tt.class, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"INGRESS_CLASS": tt.class}, ingresses...)
+			for _, ingress := range ingresses {
+				host := ingress.Spec.Rules[0].Host
+				r := query(t, s, host, dns.TypeA)
+				if served := r.Rcode == dns.RcodeSuccess; served != slices.Contains(tt.served, host) {
+					t.Errorf("%s: rcode = %s, want served = %t", host, dns.RcodeToString[r.Rcode], !served)
+				}
+			}
+		})
+	}
+}
+
+func TestCaseInsensitiveMatching(t *testing.T) {
+	s := newTestServer(t, nil,
+		newIngress("exact", "app.example.com"),
+		newIngress("wildcard", "*.apps.example.com"),
+		newIngress("upper", "UPPER.Example.com"),
+	)
+	for _, name := range []string{"App.Example.COM", "FOO.Apps.Example.Com", "upper.example.com"} {
+		r := query(t, s, name, dns.TypeA)
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+			t.Errorf("%s: rcode = %s, answer = %q, want one record", name, dns.RcodeToString[r.Rcode], rdata(r.Answer))
+			continue
+		}
+		if owner := r.Answer[0].Header().Name; owner != dns.Fqdn(name) {
+			t.Errorf("%s: owner = %s, want the query's casing", name, owner)
+		}
+	}
+}
+
+func TestResponseCodes(t *testing.T) {
+	ingress := newIngress("app", "app.example.com")
+	nxdomain := startUpstream(t, rcodeWith(dns.RcodeNameError))
+	tests := []struct {
+		name          string
+		env           map[string]string
+		host          string
+		rcode         int
+		recursion     bool
+		authoritative bool
+	}{
+		{"matched", nil, "app.example.com", dns.RcodeSuccess, false, false},
+		{"matched in zone", map[string]string{"ZONE": "example.com"}, "app.example.com", dns.RcodeSuccess, false, true},
+		{"fallback NXDOMAIN", fallbackEnv(nxdomain), "missing.example.org", dns.RcodeNameError, true, false},
+		{"fallback disabled", nil, "missing.example.org", dns.RcodeNameError, false, false},
+		{"fallback disabled, REFUSED", map[string]string{"UNMATCHED_RCODE": "REFUSED"}, "missing.example.org", dns.RcodeRefused, false, false},
+		{"unmatched in zone", map[string]string{"ZONE": "example.com"}, "missing.example.com", dns.RcodeNameError, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.env, ingress)
+			r := query(t, s, tt.host, dns.TypeA)
+			if r.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if r.RecursionAvailable != tt.recursion {
+				t.Errorf("RA = %t, want %t", r.RecursionAvailable, tt.recursion)
+			}
+			if r.Authoritative != tt.authoritative {
+				t.Errorf("AA = %t, want %t", r.Authoritative, tt.authoritative)
+			}
+		})
+	}
+}
+
+// counted wraps handler to count the queries it answers.
+func counted(count *atomic.Int64, handler dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		count.Add(1)
+		handler(w, r)
+	}
+}
+
+func TestDisableFallback(t *testing.T) {
+	var exchanges atomic.Int64
+	env := fallbackEnv(startUpstream(t, counted(&exchanges, answerWith("A 192.0.2.1", "MX 10 mail.example.org."))))
+	env["DISABLE_FALLBACK"] = "true"
+	env["MERGE_FALLBACK"] = "true"
+	s := newTestServer(t, env, withStatus(newIngress("app", "app.example.com"), "lb.example.net"))
+
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"missing.example.org", dns.TypeA},
+		{"missing.example.org", dns.TypeMX},
+		{"app.example.com", dns.TypeA},
+		{"app.example.com", dns.TypeMX},
+	} {
+		query(t, s, q.name, q.qtype)
+	}
+	if n := exchanges.Load(); n != 0 {
+		t.Errorf("upstream got %d queries with fallback disabled, want 0", n)
+	}
+}
+
+func TestCNAMEAnswers(t *testing.T) {
+	upstream := startUpstream(t, answerWith("A 192.0.2.1"))
+	ingress := withStatus(newIngress("app", "app.example.com"), "lb.example.net")
+	tests := []struct {
+		name   string
+		chase  string
+		qtype  uint16
+		answer []string
+	}{
+		{"A, CNAME only", "false", dns.TypeA, []string{"CNAME lb.example.net."}},
+		{"A, chased", "true", dns.TypeA, []string{"CNAME lb.example.net.", "A 192.0.2.1"}},
+		{"AAAA, CNAME only", "false", dns.TypeAAAA, []string{"CNAME lb.example.net."}},
+		{"CNAME", "true", dns.TypeCNAME, []string{"CNAME lb.example.net."}},
+		{"MX, CNAME only", "false", dns.TypeMX, []string{"CNAME lb.example.net."}},
+		{"TXT, CNAME only", "false", dns.TypeTXT, []string{"CNAME lb.example.net."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := fallbackEnv(upstream)
+			env["CHASE_CNAME"] = tt.chase
+			s := newTestServer(t, env, ingress)
+			r := query(t, s, "app.example.com", tt.qtype)
+			if r.Rcode != dns.RcodeSuccess {
+				t.Errorf("rcode = %s, want NOERROR", dns.RcodeToString[r.Rcode])
+			}
+			if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+		})
+	}
+}
+
+func TestSharedHostDedup(t *testing.T) {
+	tests := []struct {
+		name      string
+		ingresses []*networkingv1.Ingress
+		answer    []string
+	}{
+		{"default IP", []*networkingv1.Ingress{newIngress("a", "app.example.com"), newIngress("b", "app.example.com")}, []string{"A 10.0.0.1"}},
+		{"same status IP", []*networkingv1.Ingress{
+			withStatus(newIngress("a", "app.example.com"), "10.0.0.2"),
+			withStatus(newIngress("b", "app.example.com"), "10.0.0.2"),
+		}, []string{"A 10.0.0.2"}},
+		{"repeated rule", []*networkingv1.Ingress{newIngress("a", "app.example.com", "APP.example.com.")}, []string{"A 10.0.0.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil, tt.ingresses...)
+			if got := rdata(query(t, s, "app.example.com", dns.TypeA).Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+		})
+	}
+}
+
+func TestEDNS0(t *testing.T) {
+	s := newTestServer(t, nil, newIngress("app", "app.example.com"))
+	tests := []struct {
+		name string
+		size uint16 // 0 for no EDNS0
+		want uint16
+	}{
+		{"no EDNS0", 0, 0},
+		{"advertised size", 1232, 1232},
+		{"capped at ours", 65000, dns.DefaultMsgSize},
+		{"raised to minimum", 100, dns.MinMsgSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("app.example.com.", dns.TypeA)
+			if tt.size > 0 {
+				req.SetEdns0(tt.size, false)
+			}
+			opt := exchange(t, s, req, udpClient).IsEdns0()
+			switch {
+			case tt.want == 0 && opt != nil:
+				t.Errorf("reply has OPT %v, want none", opt)
+			case tt.want != 0 && opt == nil:
+				t.Error("reply has no OPT record")
+			case opt != nil && opt.UDPSize() != tt.want:
+				t.Errorf("UDP size = %d, want %d", opt.UDPSize(), tt.want)
+			}
+		})
+	}
+}
+
+// newSlowClient returns a clientset for an API server that never answers
+// before giving up on the request.
+func newSlowClient(t testing.TB) kubernetes.Interface {
+	t.Helper()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(api.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: api.URL})
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	return client
+}
+
+func TestKubeAPITimeout(t *testing.T) {
+	s := newServer(testConfig(t, map[string]string{"KUBE_API_TIMEOUT": "100ms"}), newSlowClient(t))
+
+	start := time.Now()
+	r := query(t, s, "app.example.com", dns.TypeA)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("query took %v against an unresponsive API server, want about KUBE_API_TIMEOUT", elapsed)
+	}
+	if r.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode = %s, want NXDOMAIN from the empty cache", dns.RcodeToString[r.Rcode])
+	}
+}
+
+func TestRequireAnnotation(t *testing.T) {
+	annotated := newIngress("annotated", "annotated.example.com")
+	annotated.Annotations = map[string]string{enabledAnnotation: "true"}
+	disabled := newIngress("disabled", "disabled.example.com")
+	disabled.Annotations = map[string]string{enabledAnnotation: "false"}
+	plain := newIngress("plain", "plain.example.com")
+
+	tests := []struct {
+		require string
+		served  []string
+	}{
+		{"false", []string{"annotated.example.com", "disabled.example.com", "plain.example.com"}},
+		{"true", []string{"annotated.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run("require="+tt.require, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"REQUIRE_ANNOTATION": tt.require}, annotated, disabled, plain)
+			for _, host := range []string{"annotated.example.com", "disabled.example.com", "plain.example.com"} {
+				r := query(t, s, host, dns.TypeA)
+				if served := r.Rcode == dns.RcodeSuccess; served != slices.Contains(tt.served, host) {
+					t.Errorf("%s: rcode = %s, want served = %t", host, dns.RcodeToString[r.Rcode], !served)
+				}
+			}
+		})
+	}
+}
+
+func TestRotateIngressIPs(t *testing.T) {
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	s := newTestServer(t, map[string]string{"INGRESS_IP": strings.Join(ips, ","), "ROTATE_INGRESS_IPS": "true"}, newIngress("app", "app.example.com"))
+
+	firsts := make(map[string]bool)
+	for range len(ips) {
+		answer := rdata(query(t, s, "app.example.com", dns.TypeA).Answer)
+		got := slices.Clone(answer)
+		slices.Sort(got)
+		if want := []string{"A 10.0.0.1", "A 10.0.0.2", "A 10.0.0.3"}; !slices.Equal(got, want) {
+			t.Fatalf("answer = %q, want all of %q", answer, want)
+		}
+		firsts[answer[0]] = true
+	}
+	if len(firsts) != len(ips) {
+		t.Errorf("first records over %d queries = %v, want each address once", len(ips), firsts)
+	}
+}
+
+func TestOtherQueryTypes(t *testing.T) {
+	var exchanges atomic.Int64
+	upstream := startUpstream(t, counted(&exchanges, answerWith("MX 10 mail.example.org.")))
+	s := newTestServer(t, fallbackEnv(upstream), withStatus(newIngress("app", "app.example.com"), "10.0.0.2", "2001:db8::2"))
+
+	tests := []struct {
+		name      string
+		host      string
+		qtype     uint16
+		answer    []string
+		forwarded bool
+	}{
+		{"ANY on a matched host", "app.example.com", dns.TypeANY, []string{"A 10.0.0.2", "AAAA 2001:db8::2"}, false},
+		{"MX on a matched host", "app.example.com", dns.TypeMX, nil, false},
+		{"MX forwarded", "forwarded.example.org", dns.TypeMX, []string{"MX 10 mail.example.org."}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := exchanges.Load()
+			r := query(t, s, tt.host, tt.qtype)
+			if r.Rcode != dns.RcodeSuccess {
+				t.Errorf("rcode = %s, want NOERROR", dns.RcodeToString[r.Rcode])
+			}
+			if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+			if forwarded := exchanges.Load() > before; forwarded != tt.forwarded {
+				t.Errorf("forwarded = %t, want %t", forwarded, tt.forwarded)
+			}
+		})
+	}
+}
+
+func TestMatchIngressFields(t *testing.T) {
+	exact := withStatus(newIngress("exact", "app.example.com"), "10.0.0.2")
+	exact.Annotations = map[string]string{ttlAnnotation: "60"}
+	wildcard := withStatus(newIngress("wildcard", "*.example.com"), "lb.example.net")
+	wildcard.Namespace = "edge"
+	ingresses := []*networkingv1.Ingress{exact, wildcard}
+	s := newTestServer(t, nil)
+
+	tests := []struct {
+		name string
+		want ingressMatch
+	}{
+		{"App.Example.com", ingressMatch{
+			Name: "app.example.com.", IPs: []string{"10.0.0.2"}, Namespace: "default", Ingress: "exact",
+			Rule: "app.example.com.", TTL: 60,
+		}},
+		{"foo.example.com", ingressMatch{
+			Name: "foo.example.com.", Hostname: "lb.example.net", Namespace: "edge", Ingress: "wildcard",
+			Rule: "*.example.com.", Wildcard: true, TTL: 30,
+		}},
+	}
+	for _, tt := range tests {
+		confirmed, err := s.matchIngress(ingresses, tt.name)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(confirmed) != 1 || !reflect.DeepEqual(confirmed[0], tt.want) {
+			t.Errorf("%s: matches = %+v, want %+v", tt.name, confirmed, tt.want)
+		}
+	}
+	if _, err := s.matchIngress(ingresses, "example.org"); !errors.Is(err, errNoMatch) {
+		t.Errorf("example.org: error = %v, want errNoMatch", err)
+	}
+}
+
+func TestTruncatedFallbackRetriesOverTCP(t *testing.T) {
+	var udp, tcp atomic.Int64
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+			udp.Add(1)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Truncated = true
+			w.WriteMsg(m)
+			return
+		}
+		tcp.Add(1)
+		answerWith("A 192.0.2.1")(w, r)
+	})
+	s := newTestServer(t, fallbackEnv(upstream))
+
+	if got := rdata(query(t, s, "forwarded.example.org", dns.TypeA).Answer); !slices.Equal(got, []string{"A 192.0.2.1"}) {
+		t.Errorf("answer = %q, want the TCP answer", got)
+	}
+	if udp.Load() != 1 || tcp.Load() != 1 {
+		t.Errorf("upstream got %d UDP and %d TCP queries, want one of each", udp.Load(), tcp.Load())
+	}
+}
+
+func TestFallbackNet(t *testing.T) {
+	var udp, tcp atomic.Int64
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+			udp.Add(1)
+		} else {
+			tcp.Add(1)
+		}
+		answerWith("A 192.0.2.1")(w, r)
+	})
+	env := fallbackEnv(upstream)
+	env["FALLBACK_NET"] = "tcp"
+	s := newTestServer(t, env)
+
+	for _, name := range []string{"a.example.org", "b.example.org"} {
+		if got := rdata(query(t, s, name, dns.TypeA).Answer); !slices.Equal(got, []string{"A 192.0.2.1"}) {
+			t.Errorf("%s: answer = %q, want the upstream's", name, got)
+		}
+	}
+	if udp.Load() != 0 || tcp.Load() != 2 {
+		t.Errorf("upstream got %d UDP and %d TCP queries, want TCP only", udp.Load(), tcp.Load())
+	}
+}
+
+// writeSelfSignedCert writes a self-signed certificate for 127.0.0.1 and
+// its key to PEM files and returns their paths.
+func writeSelfSignedCert(t testing.TB) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ingress-dns test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshalling key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("writing %s: %v", file, err)
+		}
+	}
+	return certFile, keyFile
+}
+
+func TestDoT(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCert(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("loading certificate: %v", err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	s := newTestServer(t, nil, withStatus(newIngress("app", "app.example.com"), "10.0.0.2"))
+	started := make(chan struct{})
+	server := &dns.Server{Net: "tcp-tls", Listener: l, Handler: dns.HandlerFunc(s.handleDNSRequest), NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: roots}, Timeout: 2 * time.Second}
+	req := new(dns.Msg)
+	req.SetQuestion("app.example.com.", dns.TypeA)
+	r, _, err := client.Exchange(req, l.Addr().String())
+	if err != nil {
+		t.Fatalf("DoT exchange: %v", err)
+	}
+	if got := rdata(r.Answer); !slices.Equal(got, []string{"A 10.0.0.2"}) {
+		t.Errorf("answer = %q, want [A 10.0.0.2]", got)
+	}
+}
+
+func TestListIngressesRetriesTransientErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		attempts int64
+		rcode    int
+	}{
+		{"unavailable", apierrors.NewServiceUnavailable("starting"), 2, dns.RcodeSuccess},
+		{"too many requests", apierrors.NewTooManyRequests("slow down", 0), 2, dns.RcodeSuccess},
+		{"unauthorized", apierrors.NewUnauthorized("bad token"), 1, dns.RcodeNameError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(newIngress("app", "app.example.com"))
+			var attempts atomic.Int64
+			client.PrependReactor("list", "ingresses", func(k8stesting.Action) (bool, runtime.Object, error) {
+				if attempts.Add(1) == 1 {
+					return true, nil, tt.err
+				}
+				return false, nil, nil
+			})
+			s := newServer(testConfig(t, nil), client)
+
+			if r := query(t, s, "app.example.com", dns.TypeA); r.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if n := attempts.Load(); n != tt.attempts {
+				t.Errorf("listed %d times, want %d", n, tt.attempts)
+			}
+		})
+	}
+}
+
+// failingLister is an IngressLister whose List always fails.
+type failingLister struct {
+	networkinglisters.IngressLister
+}
+
+func (failingLister) List(labels.Selector) ([]*networkingv1.Ingress, error) {
+	return nil, errors.New("list failed")
+}
+
+func TestListErrorServfail(t *testing.T) {
+	s := newTestServer(t, map[string]string{"MAINTENANCE_HOSTS": "maintained.example.com=10.0.0.9"})
+	s.ingressListers = []networkinglisters.IngressLister{failingLister{}}
+
+	if r := query(t, s, "app.example.com", dns.TypeA); r.Rcode != dns.RcodeServerFailure || len(r.Answer) != 0 {
+		t.Errorf("rcode = %s, answer = %q, want SERVFAIL without records", dns.RcodeToString[r.Rcode], rdata(r.Answer))
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("maintained.example.com.", dns.TypeA)
+	req.Question = append(req.Question, dns.Question{Name: "app.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	r := exchange(t, s, req, udpClient)
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("multi-question rcode = %s, want SERVFAIL", dns.RcodeToString[r.Rcode])
+	}
+	if got := rdata(r.Answer); !slices.Equal(got, []string{"A 10.0.0.9"}) {
+		t.Errorf("multi-question answer = %q, want the answer to the first question kept", got)
+	}
+}
+
+func TestFallbackSections(t *testing.T) {
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Authoritative = true
+		soa, _ := dns.NewRR("example.org. 300 IN SOA ns.example.org. hostmaster.example.org. 1 3600 600 86400 60")
+		extra, _ := dns.NewRR("ns.example.org. 300 IN A 192.0.2.53")
+		m.Ns = []dns.RR{soa}
+		m.Extra = []dns.RR{extra}
+		m.SetEdns0(1232, false)
+		w.WriteMsg(m)
+	})
+	s := newTestServer(t, fallbackEnv(upstream))
+
+	req := new(dns.Msg)
+	req.SetQuestion("missing.example.org.", dns.TypeA)
+	req.Id = 4242
+	r := exchange(t, s, req, udpClient)
+	if r.Id != req.Id || !r.Response || !r.RecursionDesired {
+		t.Errorf("header = id %d, QR %t, RD %t, want the query's ID and RD in a response", r.Id, r.Response, r.RecursionDesired)
+	}
+	if r.Rcode != dns.RcodeNameError || r.Authoritative || !r.RecursionAvailable {
+		t.Errorf("rcode %s, AA %t, RA %t, want NXDOMAIN with RA and without AA", dns.RcodeToString[r.Rcode], r.Authoritative, r.RecursionAvailable)
+	}
+	if got := rdata(r.Ns); len(got) != 1 || !strings.HasPrefix(got[0], "SOA ns.example.org.") {
+		t.Errorf("authority = %q, want the upstream SOA", got)
+	}
+	if got := rdata(r.Extra); !slices.Equal(got, []string{"A 192.0.2.53"}) {
+		t.Errorf("additional = %q, want the upstream glue without its OPT", got)
+	}
+}
+
+func TestFallbackSingleflight(t *testing.T) {
+	var exchanges atomic.Int64
+	upstream := startUpstream(t, counted(&exchanges, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(100 * time.Millisecond)
+		answerWith("A 192.0.2.1")(w, r)
+	}))
+	s := newTestServer(t, fallbackEnv(upstream))
+
+	const queries = 10
+	replies := make([]*dns.Msg, queries)
+	var wg sync.WaitGroup
+	for i := range queries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion("forwarded.example.org.", dns.TypeA)
+			w := &testWriter{remote: udpClient}
+			s.handleDNSRequest(w, req)
+			replies[i] = w.msg
+		}()
+	}
+	wg.Wait()
+
+	if n := exchanges.Load(); n != 1 {
+		t.Errorf("upstream got %d queries for %d concurrent identical ones, want 1", n, queries)
+	}
+	for i, r := range replies {
+		if r == nil || !slices.Equal(rdata(r.Answer), []string{"A 192.0.2.1"}) {
+			t.Errorf("query %d: reply = %v, want the upstream answer", i, r)
+		}
+	}
+}
+
+func TestFallbackSingleflightCancel(t *testing.T) {
+	received, release := make(chan struct{}, 1), make(chan struct{})
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		received <- struct{}{}
+		<-release
+		answerWith("A 192.0.2.1")(w, r)
+	})
+	s := newTestServer(t, fallbackEnv(upstream))
+
+	first, cancel := context.WithCancel(context.Background())
+	firstDone := make(chan *dns.Msg)
+	go func() { firstDone <- s.exchangeFallback(first, "forwarded.example.org", dns.TypeA) }()
+	<-received
+
+	secondDone := make(chan *dns.Msg)
+	go func() { secondDone <- s.exchangeFallback(context.Background(), "forwarded.example.org", dns.TypeA) }()
+	cancel()
+	if r := <-firstDone; r != nil {
+		t.Errorf("cancelled query got %v, want nil", r)
+	}
+	close(release)
+	if r := <-secondDone; r == nil || !slices.Equal(rdata(r.Answer), []string{"A 192.0.2.1"}) {
+		t.Errorf("waiting query got %v after the first was cancelled, want the upstream answer", r)
+	}
+}
+
+func TestTrailingDots(t *testing.T) {
+	s := newTestServer(t, nil,
+		newIngress("exact", "example.com."),
+		newIngress("wildcard", "*.example.org."),
+		newIngress("spaced", " spaced.example.com "),
+	)
+	for _, name := range []string{"example.com", "example.com.", "a.example.org", "spaced.example.com"} {
+		if r := query(t, s, name, dns.TypeA); r.Rcode != dns.RcodeSuccess || len(r.Answer) != 1 {
+			t.Errorf("%s: rcode = %s, answer = %q, want one record", name, dns.RcodeToString[r.Rcode], rdata(r.Answer))
+		}
+	}
+}
+
+func TestTTLAnnotation(t *testing.T) {
+	annotated := func(name, host, ttl string) *networkingv1.Ingress {
+		ingress := newIngress(name, host)
+		ingress.Annotations = map[string]string{ttlAnnotation: ttl}
+		return ingress
+	}
+	tests := []struct {
+		name      string
+		ingresses []*networkingv1.Ingress
+		ttl       uint32
+	}{
+		{"annotated", []*networkingv1.Ingress{annotated("app", "app.example.com", "300")}, 300},
+		{"unannotated", []*networkingv1.Ingress{newIngress("app", "app.example.com")}, 30},
+		{"invalid", []*networkingv1.Ingress{annotated("app", "app.example.com", "5m")}, 30},
+		{"lowest of shared host", []*networkingv1.Ingress{
+			annotated("a", "app.example.com", "300"),
+			annotated("b", "app.example.com", "60"),
+		}, 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil, tt.ingresses...)
+			r := query(t, s, "app.example.com", dns.TypeA)
+			if len(r.Answer) != 1 {
+				t.Fatalf("answer = %q, want one record", rdata(r.Answer))
+			}
+			if ttl := r.Answer[0].Header().Ttl; ttl != tt.ttl {
+				t.Errorf("TTL = %d, want %d", ttl, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestIngressIPHostname(t *testing.T) {
+	tests := []struct {
+		name     string
+		ingress  string
+		resolved []string
+		answer   []string
+	}{
+		{"IP", "10.0.0.1", nil, []string{"A 10.0.0.1"}},
+		{"hostname", "ingress.example.net", nil, []string{"CNAME ingress.example.net."}},
+		{"resolved hostname", "ingress.example.net", []string{"10.0.0.7"}, []string{"A 10.0.0.7"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"INGRESS_IP": tt.ingress, "CHASE_CNAME": "false"}, newIngress("app", "app.example.com"))
+			if tt.resolved != nil {
+				s.ingressHostIPs.Store(&tt.resolved)
+			}
+			if got := rdata(query(t, s, "app.example.com", dns.TypeA).Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+		})
+	}
+}
+
+func TestMaxAnswerRecords(t *testing.T) {
+	s := newTestServer(t, map[string]string{"MAX_ANSWER_RECORDS": "2"},
+		withStatus(newIngress("app", "app.example.com"), "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"))
+	req := new(dns.Msg)
+	req.SetQuestion("app.example.com.", dns.TypeA)
+
+	r := exchange(t, s, req, udpClient)
+	if len(r.Answer) != 2 || !r.Truncated {
+		t.Errorf("UDP: %d records, TC %t, want 2 with TC", len(r.Answer), r.Truncated)
+	}
+	r = exchange(t, s, req, &net.TCPAddr{IP: udpClient.IP, Port: udpClient.Port})
+	if len(r.Answer) != 4 || r.Truncated {
+		t.Errorf("TCP: %d records, TC %t, want all 4 without TC", len(r.Answer), r.Truncated)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	env := fallbackEnv(silentUpstream(t))
+	env["FALLBACK_TIMEOUT"] = "5s"
+	env["QUERY_TIMEOUT"] = "100ms"
+	s := newTestServer(t, env)
+
+	req := new(dns.Msg)
+	req.SetQuestion("slow.example.org.", dns.TypeA)
+	w := &testWriter{remote: udpClient}
+	start := time.Now()
+	s.handleDNSRequest(w, req)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("query took %v with QUERY_TIMEOUT=100ms", elapsed)
+	}
+	if w.msg != nil {
+		t.Errorf("reply written after the deadline: %v", w.msg)
+	}
+}
+
+func TestEmptyHostRules(t *testing.T) {
+	ingresses := []*networkingv1.Ingress{
+		withStatus(newIngress("catch-all", ""), "10.0.0.9"),
+		withStatus(newIngress("app", "app.example.com"), "10.0.0.2"),
+	}
+	tests := []struct {
+		matchEmpty string
+		name       string
+		rcode      int
+		answer     []string
+	}{
+		{"false", "app.example.com", dns.RcodeSuccess, []string{"A 10.0.0.2"}},
+		{"false", "other.example.com", dns.RcodeNameError, nil},
+		{"true", "app.example.com", dns.RcodeSuccess, []string{"A 10.0.0.2"}},
+		{"true", "other.example.com", dns.RcodeSuccess, []string{"A 10.0.0.9"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/match_empty="+tt.matchEmpty, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"MATCH_EMPTY_HOST": tt.matchEmpty}, ingresses...)
+			r := query(t, s, tt.name, dns.TypeA)
+			if r.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+		})
+	}
+}
+
+func TestSharedHostAcrossControllers(t *testing.T) {
+	s := newTestServer(t, nil,
+		withClass(withStatus(newIngress("nginx", "app.example.com"), "10.0.0.2"), "nginx"),
+		withClass(withStatus(newIngress("traefik", "app.example.com"), "10.0.0.3", "10.0.0.2"), "traefik"),
+	)
+	got := rdata(query(t, s, "app.example.com", dns.TypeA).Answer)
+	slices.Sort(got)
+	if want := []string{"A 10.0.0.2", "A 10.0.0.3"}; !slices.Equal(got, want) {
+		t.Errorf("answer = %q, want %q", got, want)
+	}
+}
+
+func TestWildcardMultiLevel(t *testing.T) {
+	servers := map[string]*Server{}
+	for _, mode := range []string{"false", "true"} {
+		servers[mode] = newTestServer(t, map[string]string{"WILDCARD_MULTILEVEL": mode}, newIngress("wildcard", "*.example.com"))
+	}
+	tests := []struct {
+		name       string
+		multiLevel string
+		rcode      int
+	}{
+		{"a.example.com", "false", dns.RcodeSuccess},
+		{"a.example.com", "true", dns.RcodeSuccess},
+		{"a.b.example.com", "false", dns.RcodeNameError},
+		{"a.b.example.com", "true", dns.RcodeSuccess},
+		{"x.y.z.example.com", "true", dns.RcodeSuccess},
+		{"example.com", "false", dns.RcodeNameError},
+		{"example.com", "true", dns.RcodeNameError},
+	}
+	for _, tt := range tests {
+		if r := query(t, servers[tt.multiLevel], tt.name, dns.TypeA); r.Rcode != tt.rcode {
+			t.Errorf("%s with WILDCARD_MULTILEVEL=%s: rcode = %s, want %s", tt.name, tt.multiLevel, dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+		}
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("finding a free port: %v", err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	s := newTestServer(t, nil, newIngress("app", "app.example.com"))
+	for i := range 2 {
+		started := make(chan struct{})
+		failed := make(chan error, 1)
+		server := &dns.Server{Addr: addr, Net: "udp", ReusePort: true, Handler: dns.HandlerFunc(s.handleDNSRequest), NotifyStartedFunc: func() { close(started) }}
+		go func() { failed <- server.ListenAndServe() }()
+		select {
+		case <-started:
+			t.Cleanup(func() { server.Shutdown() })
+		case err := <-failed:
+			t.Fatalf("listener %d on %s: %v", i+1, addr, err)
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("app.example.com.", dns.TypeA)
+	r, err := dns.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if got := rdata(r.Answer); !slices.Equal(got, []string{"A 10.0.0.1"}) {
+		t.Errorf("answer = %q, want [A 10.0.0.1]", got)
+	}
+}
+
+func TestTXTAnnotation(t *testing.T) {
+	annotated := newIngress("annotated", "annotated.example.com")
+	annotated.Annotations = map[string]string{txtAnnotation: "v=spf1 -all\n\n  owner=team-a  \n" + strings.Repeat("x", 300)}
+	plain := newIngress("plain", "plain.example.com")
+
+	tests := []struct {
+		name   string
+		zone   string
+		answer []string
+		soa    bool
+	}{
+		{"annotated.example.com", "", []string{`TXT "v=spf1 -all"`, `TXT "owner=team-a"`, `TXT "` + strings.Repeat("x", 255) + `" "` + strings.Repeat("x", 45) + `"`}, false},
+		{"plain.example.com", "", nil, false},
+		{"plain.example.com", "example.com", nil, true},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t, map[string]string{"ZONE": tt.zone}, annotated, plain)
+		r := query(t, s, tt.name, dns.TypeTXT)
+		if r.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: rcode = %s, want NOERROR", tt.name, dns.RcodeToString[r.Rcode])
+		}
+		if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+			t.Errorf("%s: answer = %q, want %q", tt.name, got, tt.answer)
+		}
+		if soa := len(r.Ns) == 1 && r.Ns[0].Header().Rrtype == dns.TypeSOA; soa != tt.soa {
+			t.Errorf("%s in zone %q: authority = %v, want an SOA: %t", tt.name, tt.zone, r.Ns, tt.soa)
+		}
+	}
+}
+
+func TestProcessQuery(t *testing.T) {
+	client := fake.NewSimpleClientset(withStatus(newIngress("app", "app.example.com"), "10.0.0.2"))
+	s := newServer(testConfig(t, nil), client)
+
+	tests := []struct {
+		name   string
+		rcode  int
+		answer []string
+	}{
+		{"app.example.com.", dns.RcodeSuccess, []string{"A 10.0.0.2"}},
+		{"missing.example.com.", dns.RcodeNameError, nil},
+	}
+	for _, tt := range tests {
+		m := new(dns.Msg)
+		s.processQuery(context.Background(), m, dns.Question{Name: tt.name, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+		if m.Rcode != tt.rcode {
+			t.Errorf("%s: rcode = %s, want %s", tt.name, dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		if got := rdata(m.Answer); !slices.Equal(got, tt.answer) {
+			t.Errorf("%s: answer = %q, want %q", tt.name, got, tt.answer)
+		}
+	}
+}
+
+func TestRestConfig(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: kind
+  cluster:
+    server: https://127.0.0.1:6443
+users:
+- name: kind
+  user:
+    token: secret
+contexts:
+- name: kind
+  context:
+    cluster: kind
+    user: kind
+current-context: kind
+`), 0o600)
+	if err != nil {
+		t.Fatalf("writing kubeconfig: %v", err)
+	}
+	t.Setenv("KUBECONFIG", kubeconfig)
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+
+	if _, err := restConfig(false); err == nil {
+		t.Error("restConfig(false) succeeded outside a cluster")
+	}
+	config, err := restConfig(true)
+	if err != nil {
+		t.Fatalf("restConfig(true): %v", err)
+	}
+	if config.Host != "https://127.0.0.1:6443" || config.BearerToken != "secret" {
+		t.Errorf("config = host %q, token %q, want the kubeconfig's", config.Host, config.BearerToken)
+	}
+}
+
+func TestStripSuffix(t *testing.T) {
+	s := newTestServer(t, map[string]string{"STRIP_SUFFIX": "corp.example.net,svc.cluster.local"},
+		withStatus(newIngress("app", "app.example.com"), "10.0.0.2"),
+		withStatus(newIngress("suffixed", "db.corp.example.net"), "10.0.0.3"))
+	tests := []struct {
+		name   string
+		rcode  int
+		answer []string
+	}{
+		{"app.example.com", dns.RcodeSuccess, []string{"A 10.0.0.2"}},
+		{"app.example.com.corp.example.net", dns.RcodeSuccess, []string{"A 10.0.0.2"}},
+		{"APP.example.com.svc.cluster.local", dns.RcodeSuccess, []string{"A 10.0.0.2"}},
+		{"db.corp.example.net", dns.RcodeSuccess, []string{"A 10.0.0.3"}},
+		{"corp.example.net", dns.RcodeNameError, nil},
+		{"missing.example.com.corp.example.net", dns.RcodeNameError, nil},
+	}
+	for _, tt := range tests {
+		r := query(t, s, tt.name, dns.TypeA)
+		if r.Rcode != tt.rcode {
+			t.Errorf("%s: rcode = %s, want %s", tt.name, dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+			t.Errorf("%s: answer = %q, want %q", tt.name, got, tt.answer)
+		}
+		for _, rr := range r.Answer {
+			if rr.Header().Name != dns.Fqdn(tt.name) {
+				t.Errorf("%s: owner = %s, want the queried name", tt.name, rr.Header().Name)
+			}
+		}
+	}
+}
+
+func TestWildcardApex(t *testing.T) {
+	tests := []struct {
+		apex  string
+		name  string
+		rcode int
+	}{
+		{"false", "example.com", dns.RcodeNameError},
+		{"false", "a.example.com", dns.RcodeSuccess},
+		{"true", "example.com", dns.RcodeSuccess},
+		{"true", "a.example.com", dns.RcodeSuccess},
+		{"true", "com", dns.RcodeNameError},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t, map[string]string{"WILDCARD_INCLUDES_APEX": tt.apex}, newIngress("wildcard", "*.example.com"))
+		if r := query(t, s, tt.name, dns.TypeA); r.Rcode != tt.rcode {
+			t.Errorf("%s with WILDCARD_INCLUDES_APEX=%s: rcode = %s, want %s", tt.name, tt.apex, dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+		}
+	}
+}
+
+func TestMergeFallback(t *testing.T) {
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		switch r.Question[0].Qtype {
+		case dns.TypeMX:
+			answerWith("MX 10 mail.example.com.")(w, r)
+		default:
+			answerWith("A 192.0.2.1")(w, r)
+		}
+	})
+	ingress := withStatus(newIngress("app", "app.example.com"), "10.0.0.2")
+	tests := []struct {
+		merge  string
+		qtype  uint16
+		answer []string
+	}{
+		{"true", dns.TypeA, []string{"A 10.0.0.2"}},
+		{"true", dns.TypeMX, []string{"MX 10 mail.example.com."}},
+		{"false", dns.TypeA, []string{"A 10.0.0.2"}},
+		{"false", dns.TypeMX, nil},
+	}
+	for _, tt := range tests {
+		env := fallbackEnv(upstream)
+		env["MERGE_FALLBACK"] = tt.merge
+		s := newTestServer(t, env, ingress)
+		r := query(t, s, "app.example.com", tt.qtype)
+		if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+			t.Errorf("%s with MERGE_FALLBACK=%s: answer = %q, want %q", dns.Type(tt.qtype), tt.merge, got, tt.answer)
+		}
+	}
+
+	env := fallbackEnv(upstream)
+	env["MERGE_FALLBACK"] = "true"
+	s := newTestServer(t, env, ingress)
+	req := new(dns.Msg)
+	req.SetQuestion("app.example.com.", dns.TypeA)
+	req.Question = append(req.Question, dns.Question{Name: "app.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET})
+	got := rdata(exchange(t, s, req, udpClient).Answer)
+	if want := []string{"A 10.0.0.2", "MX 10 mail.example.com."}; !slices.Equal(got, want) {
+		t.Errorf("A and MX in one message: answer = %q, want %q", got, want)
+	}
+}
+
+func TestMaintenanceHosts(t *testing.T) {
+	s := newTestServer(t, map[string]string{"MAINTENANCE_HOSTS": "app.example.com=10.0.0.99,App.example.com=2001:db8::99"},
+		withStatus(newIngress("app", "app.example.com", "other.example.com"), "10.0.0.2"))
+	tests := []struct {
+		name   string
+		qtype  uint16
+		answer []string
+	}{
+		{"app.example.com", dns.TypeA, []string{"A 10.0.0.99"}},
+		{"APP.example.com", dns.TypeAAAA, []string{"AAAA 2001:db8::99"}},
+		{"other.example.com", dns.TypeA, []string{"A 10.0.0.2"}},
+	}
+	for _, tt := range tests {
+		if got := rdata(query(t, s, tt.name, tt.qtype).Answer); !slices.Equal(got, tt.answer) {
+			t.Errorf("%s %s: answer = %q, want %q", tt.name, dns.Type(tt.qtype), got, tt.answer)
+		}
+	}
+}
+
+func TestMatchAnnotation(t *testing.T) {
+	withPattern := func(name, pattern string) *networkingv1.Ingress {
+		ingress := withStatus(newIngress(name), "10.0.0.2")
+		ingress.Annotations = map[string]string{matchAnnotation: pattern}
+		return ingress
+	}
+	tests := []struct {
+		pattern string
+		name    string
+		matched bool
+	}{
+		{`api-[0-9]+\.example\.com`, "api-12.example.com", true},
+		{`api-[0-9]+\.example\.com`, "API-12.Example.com", true},
+		{`api-[0-9]+\.example\.com`, "api-x.example.com", false},
+		{`api-[0-9]+\.example\.com`, "evil.api-12.example.com", false},
+		{`api-[0-9]+\.example\.com`, "api-12.example.com.evil.org", false},
+		{`(a|b)\.example\.com`, "a.example.com", true},
+		{`(a|b\.example\.com`, "a.example.com", false},
+		{strings.Repeat("a", maxMatchPattern+1), strings.Repeat("a", maxMatchPattern+1), false},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t, nil, withPattern("pattern", tt.pattern))
+		r := query(t, s, tt.name, dns.TypeA)
+		if matched := r.Rcode == dns.RcodeSuccess; matched != tt.matched {
+			t.Errorf("%q against %q: rcode = %s, want matched = %t", tt.name, tt.pattern, dns.RcodeToString[r.Rcode], tt.matched)
+		}
+	}
+}
+
+func TestErrorRcodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		lister networkinglisters.IngressLister
+		host   string
+		rcode  int
+	}{
+		{"no match", nil, nil, "missing.example.com", dns.RcodeNameError},
+		{"no match, UNMATCHED_RCODE", map[string]string{"UNMATCHED_RCODE": "SERVFAIL"}, nil, "missing.example.com", dns.RcodeServerFailure},
+		{"no address", map[string]string{"INGRESS_IP": "0.0.0.0"}, nil, "app.example.com", dns.RcodeServerFailure},
+		{"API unavailable", nil, failingLister{}, "app.example.com", dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.env, newIngress("app", "app.example.com"))
+			if tt.lister != nil {
+				s.ingressListers = []networkinglisters.IngressLister{tt.lister}
+			}
+			if r := query(t, s, tt.host, dns.TypeA); r.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+		})
+	}
+}
+
+func TestFallbackFastest(t *testing.T) {
+	slow := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(300 * time.Millisecond)
+		answerWith("A 192.0.2.1")(w, r)
+	})
+	fast := startUpstream(t, answerWith("A 192.0.2.2"))
+	failing := startUpstream(t, rcodeWith(dns.RcodeServerFailure))
+
+	tests := []struct {
+		strategy string
+		servers  []string
+		answer   []string
+	}{
+		{"fastest", []string{slow, fast}, []string{"A 192.0.2.2"}},
+		{"fastest", []string{failing, slow}, []string{"A 192.0.2.1"}},
+		{"sequential", []string{slow, fast}, []string{"A 192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		env := fallbackEnv(tt.servers...)
+		env["FALLBACK_STRATEGY"] = tt.strategy
+		s := newTestServer(t, env)
+		start := time.Now()
+		got := rdata(query(t, s, "forwarded.example.org", dns.TypeA).Answer)
+		if !slices.Equal(got, tt.answer) {
+			t.Errorf("%s over %q: answer = %q, want %q", tt.strategy, tt.servers, got, tt.answer)
+		}
+		if elapsed := time.Since(start); tt.answer[0] == "A 192.0.2.2" && elapsed > 200*time.Millisecond {
+			t.Errorf("%s: took %v, want the fast server's answer without waiting for the slow one", tt.strategy, elapsed)
+		}
+	}
+}
+
+func TestMessageValidation(t *testing.T) {
+	s := newTestServer(t, nil, newIngress("app", "app.example.com"))
+	update := new(dns.Msg)
+	update.SetUpdate("example.com.")
+	update.Insert([]dns.RR{mustRR(t, "app.example.com. 300 IN A 10.0.0.9")})
+	notify := new(dns.Msg)
+	notify.SetNotify("example.com.")
+	tests := []struct {
+		name  string
+		req   *dns.Msg
+		rcode int
+	}{
+		{"UPDATE", update, dns.RcodeRefused},
+		{"NOTIFY", notify, dns.RcodeRefused},
+		{"no question", &dns.Msg{MsgHdr: dns.MsgHdr{Id: 42, RecursionDesired: true}}, dns.RcodeFormatError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := exchange(t, s, tt.req, udpClient)
+			if r.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if !r.Response || r.Id != tt.req.Id || r.Opcode != tt.req.Opcode {
+				t.Errorf("reply header %+v doesn't answer %+v", r.MsgHdr, tt.req.MsgHdr)
+			}
+			if len(r.Answer) != 0 {
+				t.Errorf("answer = %v, want none", r.Answer)
+			}
+		})
+	}
+	if got := rdata(query(t, s, "app.example.com", dns.TypeA).Answer); !slices.Equal(got, []string{"A 10.0.0.1"}) {
+		t.Errorf("answer after the UPDATE = %q, want [A 10.0.0.1]", got)
+	}
+}
+
+func TestZoneForwarders(t *testing.T) {
+	internal := startUpstream(t, answerWith("A 10.1.0.1"))
+	other := startUpstream(t, answerWith("A 10.2.0.1"))
+	public := startUpstream(t, answerWith("A 192.0.2.1"))
+	env := fallbackEnv(public)
+	env["ZONE_FORWARDERS"] = "internal.corp=" + internal + ", Other.Internal.Corp.=" + other
+	s := newTestServer(t, env)
+	tests := []struct {
+		host   string
+		answer []string
+	}{
+		{"app.internal.corp", []string{"A 10.1.0.1"}},
+		{"internal.corp", []string{"A 10.1.0.1"}},
+		{"DB.Internal.Corp", []string{"A 10.1.0.1"}},
+		{"app.other.internal.corp", []string{"A 10.2.0.1"}},
+		{"notinternal.corp", []string{"A 192.0.2.1"}},
+		{"example.org", []string{"A 192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		if got := rdata(query(t, s, tt.host, dns.TypeA).Answer); !slices.Equal(got, tt.answer) {
+			t.Errorf("%s: answer = %q, want %q", tt.host, got, tt.answer)
+		}
+	}
+}
+
+func TestParseZoneForwarders(t *testing.T) {
+	got, err := parseZoneForwarders([]string{"internal.corp=10.0.0.53:53", "Internal.Corp.=10.0.0.54:53", "lab=[2001:db8::53]:53"})
+	if err != nil {
+		t.Fatalf("parseZoneForwarders: %v", err)
+	}
+	want := map[string][]string{
+		"internal.corp.": {"10.0.0.53:53", "10.0.0.54:53"},
+		"lab.":           {"[2001:db8::53]:53"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseZoneForwarders = %v, want %v", got, want)
+	}
+	for _, value := range []string{"internal.corp", "=10.0.0.53:53", "internal.corp=10.0.0.53"} {
+		if _, err := parseZoneForwarders([]string{value}); err == nil {
+			t.Errorf("parseZoneForwarders(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestSelfNames(t *testing.T) {
+	env := map[string]string{"SELF_NAMES": "dns.example.com, DNS-0.dns.default.svc.cluster.local.", "POD_IP": "10.0.0.53"}
+	s := newTestServer(t, env, withStatus(newIngress("app", "*.example.com"), "10.0.0.2"))
+	tests := []struct {
+		host   string
+		qtype  uint16
+		answer []string
+	}{
+		{"dns.example.com", dns.TypeA, []string{"A 10.0.0.53"}},
+		{"dns-0.dns.default.svc.cluster.local", dns.TypeA, []string{"A 10.0.0.53"}},
+		{"dns.example.com", dns.TypeAAAA, nil},
+		{"other.example.com", dns.TypeA, []string{"A 10.0.0.2"}},
+	}
+	for _, tt := range tests {
+		r := query(t, s, tt.host, tt.qtype)
+		if got := rdata(r.Answer); r.Rcode != dns.RcodeSuccess || !slices.Equal(got, tt.answer) {
+			t.Errorf("%s %s: %s %q, want NOERROR %q", tt.host, dns.Type(tt.qtype), dns.RcodeToString[r.Rcode], got, tt.answer)
+		}
+	}
+
+	t.Setenv("POD_IP", "")
+	t.Setenv("SELF_NAMES", "dns.example.com")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig with SELF_NAMES but no POD_IP succeeded, want an error")
+	}
+}
+
+func TestAnswerDedup(t *testing.T) {
+	env := map[string]string{"INGRESS_IPV6": "2001:db8::1"}
+	s := newTestServer(t, env, newIngress("app", "app.example.com"))
+	// The second question is answered from the response cache the first
+	// filled, and ANY repeats the A record of both.
+	req := new(dns.Msg)
+	req.SetQuestion("app.example.com.", dns.TypeA)
+	req.Question = append(req.Question, req.Question[0], dns.Question{Name: "APP.example.com.", Qtype: dns.TypeANY, Qclass: dns.ClassINET})
+	r := exchange(t, s, req, udpClient)
+	got := rdata(r.Answer)
+	slices.Sort(got)
+	if want := []string{"A 10.0.0.1", "AAAA 2001:db8::1"}; !slices.Equal(got, want) {
+		t.Errorf("answer = %q, want %q", got, want)
+	}
+}
+
+func TestNoIPBehavior(t *testing.T) {
+	upstream := startUpstream(t, answerWith("A 192.0.2.1"))
+	ingress := newIngress("app", "app.example.com")
+	tests := []struct {
+		name   string
+		env    map[string]string
+		rcode  int
+		answer []string
+		soa    bool
+	}{
+		{"default", nil, dns.RcodeServerFailure, nil, false},
+		{"servfail", map[string]string{"NO_IP_BEHAVIOR": "servfail"}, dns.RcodeServerFailure, nil, false},
+		{"nodata", map[string]string{"NO_IP_BEHAVIOR": "nodata"}, dns.RcodeSuccess, nil, false},
+		{"nodata in zone", map[string]string{"NO_IP_BEHAVIOR": "nodata", "ZONE": "example.com"}, dns.RcodeSuccess, nil, true},
+		{"fallback", map[string]string{"NO_IP_BEHAVIOR": "fallback", "DISABLE_FALLBACK": "false", "FALLBACK_DNS": upstream}, dns.RcodeSuccess, []string{"A 192.0.2.1"}, false},
+		{"fallback disabled", map[string]string{"NO_IP_BEHAVIOR": "fallback"}, dns.RcodeServerFailure, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{"INGRESS_IP": "0.0.0.0"}
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			s := newTestServer(t, env, ingress)
+			r := query(t, s, "app.example.com", dns.TypeA)
+			if r.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+			if soa := len(r.Ns) == 1 && r.Ns[0].Header().Rrtype == dns.TypeSOA; soa != tt.soa {
+				t.Errorf("authority = %v, want SOA: %t", r.Ns, tt.soa)
+			}
+		})
+	}
+
+	t.Setenv("NO_IP_BEHAVIOR", "ignore")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig with NO_IP_BEHAVIOR=ignore succeeded, want an error")
+	}
+}
+
+// captureLogs sends the default logger's records, debug ones included, to
+// the returned buffer as JSON lines until the test ends.
+func captureLogs(t testing.TB) *syncBuffer {
+	t.Helper()
+	buf := new(syncBuffer)
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return buf
+}
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of a logger.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns the logged records with message msg.
+func (b *syncBuffer) records(t testing.TB, msg string) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	for _, line := range bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var record map[string]any
+		if err := json.Unmarshal(line, &record); err != nil {
+			t.Fatalf("decoding log line %q: %v", line, err)
+		}
+		if record["msg"] == msg {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestMalformedWildcardHosts(t *testing.T) {
+	logs := captureLogs(t)
+	ingresses := []*networkingv1.Ingress{
+		newIngress("star-dot", "*."),
+		newIngress("star-dots", "*..", "*.a..b"),
+		newIngress("app", "*.example.com"),
+	}
+	s := newTestServer(t, nil, ingresses...)
+	for _, host := range []string{"example.org", "a.example.org", "a.b", "com"} {
+		if r := query(t, s, host, dns.TypeA); r.Rcode != dns.RcodeNameError || len(r.Answer) != 0 {
+			t.Errorf("%s: %s %v, want NXDOMAIN", host, dns.RcodeToString[r.Rcode], r.Answer)
+		}
+	}
+	if got := rdata(query(t, s, "web.example.com", dns.TypeA).Answer); !slices.Equal(got, []string{"A 10.0.0.1"}) {
+		t.Errorf("web.example.com: answer = %q, want [A 10.0.0.1]", got)
+	}
+
+	if got := s.malformedHosts(ingresses); got != 3 {
+		t.Errorf("malformedHosts = %d, want 3", got)
+	}
+	if hosts := s.servedHosts(ingresses); len(hosts) != 1 || !hosts["*.example.com."] {
+		t.Errorf("servedHosts = %v, want only *.example.com.", hosts)
+	}
+	warnings := logs.records(t, "Skipping malformed wildcard host")
+	var hosts []string
+	for _, record := range warnings {
+		hosts = append(hosts, record["host"].(string))
+	}
+	slices.Sort(hosts)
+	if want := []string{"*.", "*..", "*.a..b"}; !slices.Equal(hosts, want) {
+		t.Errorf("warned about %q after 5 queries, want each of %q once", hosts, want)
+	}
+}
+
+func TestMinimalANY(t *testing.T) {
+	path := writeStaticHosts(t, "10.0.0.5 static.example.com\n")
+	env := map[string]string{"INGRESS_IPV6": "2001:db8::1", "STATIC_HOSTS": path}
+	ingress := newIngress("app", "app.example.com")
+	tests := []struct {
+		name    string
+		minimal string
+		host    string
+		answer  []string
+	}{
+		// Full ANY gets every address type synthesized for the name.
+		{"full", "false", "app.example.com", []string{"A 10.0.0.1", "AAAA 2001:db8::1"}},
+		{"minimal", "true", "app.example.com", []string{"HINFO \"RFC8482\" \"\""}},
+		{"full static", "false", "static.example.com", []string{"A 10.0.0.5"}},
+		{"minimal static", "true", "static.example.com", []string{"HINFO \"RFC8482\" \"\""}},
+		{"minimal unmatched", "true", "missing.example.com", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env["MINIMAL_ANY"] = tt.minimal
+			s := newTestServer(t, env, ingress)
+			if err := s.loadStaticHosts(path); err != nil {
+				t.Fatalf("loadStaticHosts: %v", err)
+			}
+			got := rdata(query(t, s, tt.host, dns.TypeANY).Answer)
+			slices.Sort(got)
+			if !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+			// Other types are answered as usual.
+			if got := rdata(query(t, s, "app.example.com", dns.TypeA).Answer); !slices.Equal(got, []string{"A 10.0.0.1"}) {
+				t.Errorf("A answer = %q, want [A 10.0.0.1]", got)
+			}
+		})
+	}
+}
+
+func TestMaxUDPSize(t *testing.T) {
+	ips := make([]string, 40)
+	for i := range ips {
+		ips[i] = net.IPv4(10, 0, 1, byte(i+1)).String()
+	}
+	ingress := withStatus(newIngress("big", "big.example.com"), ips...)
+	req := new(dns.Msg)
+	req.SetQuestion("big.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+
+	// The size of the whole reply, compressed as UDP replies are, is what
+	// MAX_UDP_SIZE must allow for it to go out untruncated.
+	reply := exchange(t, newTestServer(t, nil, ingress), req, tcpClient)
+	reply.Compress = true
+	full, err := reply.Pack()
+	if err != nil {
+		t.Fatalf("packing reply: %v", err)
+	}
+	if len(full) <= dns.MinMsgSize {
+		t.Fatalf("reply of %d bytes fits the minimum size, test needs a larger one", len(full))
+	}
+	tests := []struct {
+		name      string
+		maxSize   int
+		truncated bool
+	}{
+		{"unset", 0, false},
+		{"exact fit", len(full), false},
+		{"one byte short", len(full) - 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"MAX_UDP_SIZE": strconv.Itoa(tt.maxSize)}, ingress)
+			r := exchange(t, s, req, udpClient)
+			if r.Truncated != tt.truncated {
+				t.Errorf("TC = %t, want %t", r.Truncated, tt.truncated)
+			}
+			if packed, _ := r.Pack(); tt.maxSize > 0 && len(packed) > tt.maxSize {
+				t.Errorf("reply of %d bytes exceeds MAX_UDP_SIZE %d", len(packed), tt.maxSize)
+			}
+			if opt := r.IsEdns0(); tt.maxSize > 0 && (opt == nil || int(opt.UDPSize()) != tt.maxSize) {
+				t.Errorf("OPT = %v, want a UDP size of %d", opt, tt.maxSize)
+			}
+			if r := exchange(t, s, req, tcpClient); r.Truncated || len(r.Answer) != len(ips) {
+				t.Errorf("over TCP: TC %t and %d answers, want all %d", r.Truncated, len(r.Answer), len(ips))
+			}
+		})
+	}
+}
+
+func TestWeightedIngressIPs(t *testing.T) {
+	s := newTestServer(t, map[string]string{"INGRESS_IP": "10.0.0.1:3, 10.0.0.2:1, 10.0.0.3"}, newIngress("app", "app.example.com"))
+	const queries = 5000
+	first := make(map[string]int)
+	for range queries {
+		r := query(t, s, "app.example.com", dns.TypeA)
+		if len(r.Answer) != 3 {
+			t.Fatalf("answer = %v, want all 3 addresses", r.Answer)
+		}
+		first[r.Answer[0].(*dns.A).A.String()]++
+	}
+	for ip, weight := range map[string]int{"10.0.0.1": 3, "10.0.0.2": 1, "10.0.0.3": 1} {
+		want := float64(weight) / 5
+		if got := float64(first[ip]) / queries; math.Abs(got-want) > 0.05 {
+			t.Errorf("%s came first in %.1f%% of the answers, want about %.0f%%", ip, 100*got, 100*want)
+		}
+	}
+}
+
+func TestAuthoritativeAnswers(t *testing.T) {
+	upstream := startUpstream(t, answerWith("A 192.0.2.1"))
+	path := writeStaticHosts(t, "10.0.0.5 static.example.com static.example.net\n")
+	env := fallbackEnv(upstream)
+	env["ZONE"] = "example.com"
+	env["STATIC_HOSTS"] = path
+	s := newTestServer(t, env, newIngress("app", "app.example.com", "app.example.net"))
+	if err := s.loadStaticHosts(path); err != nil {
+		t.Fatalf("loadStaticHosts: %v", err)
+	}
+	tests := []struct {
+		name  string
+		names []string
+		aa    bool
+	}{
+		{"ingress in zone", []string{"app.example.com"}, true},
+		{"ingress outside zone", []string{"app.example.net"}, false},
+		{"static host in zone", []string{"static.example.com"}, true},
+		{"static host outside zone", []string{"static.example.net"}, false},
+		{"NXDOMAIN in zone", []string{"missing.example.com"}, true},
+		{"forwarded", []string{"example.org"}, false},
+		{"in zone and forwarded", []string{"app.example.com", "example.org"}, false},
+		{"all in zone", []string{"app.example.com", "static.example.com"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The second round is answered from the cache.
+			for _, round := range []string{"first", "cached"} {
+				req := new(dns.Msg)
+				for _, name := range tt.names {
+					req.Question = append(req.Question, dns.Question{Name: dns.Fqdn(name), Qtype: dns.TypeA, Qclass: dns.ClassINET})
+				}
+				if r := exchange(t, s, req, udpClient); r.Authoritative != tt.aa {
+					t.Errorf("%s: AA = %t, want %t", round, r.Authoritative, tt.aa)
+				}
+			}
+		})
+	}
+
+	s.ingressListers = []networkinglisters.IngressLister{failingLister{}}
+	s.responses.flush()
+	if r := query(t, s, "app.example.com", dns.TypeA); r.Rcode != dns.RcodeServerFailure || r.Authoritative {
+		t.Errorf("on a list error: %s with AA %t, want SERVFAIL without AA", dns.RcodeToString[r.Rcode], r.Authoritative)
+	}
+}
+
+func TestWildcardStatusAddresses(t *testing.T) {
+	ingresses := []*networkingv1.Ingress{
+		withStatus(newIngress("wildcard", "*.example.com"), "10.0.0.7", "2001:db8::7"),
+		withStatus(newIngress("apps", "*.apps.example.com"), "lb.example.net"),
+		withStatus(newIngress("exact", "www.example.com"), "10.0.0.8"),
+	}
+	s := newTestServer(t, map[string]string{"INGRESS_IPV6": "2001:db8::1"}, ingresses...)
+	tests := []struct {
+		host   string
+		qtype  uint16
+		answer []string
+	}{
+		{"app.example.com", dns.TypeA, []string{"A 10.0.0.7"}},
+		{"app.example.com", dns.TypeAAAA, []string{"AAAA 2001:db8::7"}},
+		{"web.apps.example.com", dns.TypeA, []string{"CNAME lb.example.net."}},
+		{"www.example.com", dns.TypeA, []string{"A 10.0.0.8"}},
+	}
+	for _, tt := range tests {
+		if got := rdata(query(t, s, tt.host, tt.qtype).Answer); !slices.Equal(got, tt.answer) {
+			t.Errorf("%s %s: answer = %q, want %q", tt.host, dns.Type(tt.qtype), got, tt.answer)
+		}
+	}
+
+	confirmed, err := s.matchIngress(ingresses, "App.Example.com")
+	if err != nil {
+		t.Fatalf("matchIngress: %v", err)
+	}
+	if len(confirmed) != 1 || confirmed[0].Ingress != "wildcard" || !confirmed[0].Wildcard || !slices.Equal(confirmed[0].IPs, []string{"10.0.0.7", "2001:db8::7"}) {
+		t.Errorf("matchIngress = %+v, want the wildcard ingress with its status addresses", confirmed)
+	}
+}
+
+// forbidNamespace makes client refuse to list resource in namespace, as
+// RBAC does for a service account without access to it.
+func forbidNamespace(client *fake.Clientset, resource, namespace string) {
+	client.PrependReactor("list", resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() != namespace {
+			return false, nil, nil
+		}
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "networking.k8s.io", Resource: resource}, "", errors.New("RBAC: access denied"))
+	})
+}
+
+func TestPartialPermissions(t *testing.T) {
+	secret := withStatus(newIngress("secret", "secret.example.com"), "10.0.0.9")
+	secret.Namespace = "secret"
+	newClient := func() *fake.Clientset {
+		client := fake.NewSimpleClientset(withStatus(newIngress("app", "app.example.com"), "10.0.0.2"), secret)
+		forbidNamespace(client, "ingresses", "secret")
+		return client
+	}
+	env := map[string]string{"WATCH_NAMESPACES": "default,secret"}
+	check := func(t *testing.T, s *Server) {
+		t.Helper()
+		if got := rdata(query(t, s, "app.example.com", dns.TypeA).Answer); !slices.Equal(got, []string{"A 10.0.0.2"}) {
+			t.Errorf("app.example.com: answer = %q, want [A 10.0.0.2]", got)
+		}
+		if r := query(t, s, "secret.example.com", dns.TypeA); r.Rcode != dns.RcodeNameError {
+			t.Errorf("secret.example.com: %s %q, want NXDOMAIN", dns.RcodeToString[r.Rcode], rdata(r.Answer))
+		}
+	}
+
+	t.Run("informer", func(t *testing.T) {
+		s := newInformerServer(t, env, newClient())
+		if !s.cacheSynced.Load() {
+			t.Fatal("cache not synced with one namespace forbidden")
+		}
+		check(t, s)
+	})
+	t.Run("list before sync", func(t *testing.T) {
+		s := newServer(testConfig(t, env), newClient())
+		check(t, s)
+	})
+	t.Run("all forbidden", func(t *testing.T) {
+		client := newClient()
+		forbidNamespace(client, "ingresses", "default")
+		s := newServer(testConfig(t, env), client)
+		if _, err := s.listIngresses(context.Background()); err == nil {
+			t.Error("listIngresses succeeded in no namespace, want an error")
+		}
+	})
+}
+
+func TestMatchTLSHosts(t *testing.T) {
+	ingress := withStatus(newIngress("app", "app.example.com"), "10.0.0.2")
+	ingress.Spec.TLS = []networkingv1.IngressTLS{
+		{Hosts: []string{"app.example.com", "Secure.Example.com"}},
+		{Hosts: []string{"*.tls.example.com", " "}},
+	}
+	tests := []struct {
+		host    string
+		enabled bool
+		matched bool
+	}{
+		{"app.example.com", false, true},
+		{"secure.example.com", false, false},
+		{"app.example.com", true, true},
+		{"secure.example.com", true, true},
+		{"SECURE.example.com", true, true},
+		{"web.tls.example.com", true, true},
+		{"tls.example.com", true, false},
+		{"a.b.tls.example.com", true, false},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t, map[string]string{"MATCH_TLS_HOSTS": strconv.FormatBool(tt.enabled)}, ingress)
+		r := query(t, s, tt.host, dns.TypeA)
+		if matched := slices.Equal(rdata(r.Answer), []string{"A 10.0.0.2"}); matched != tt.matched {
+			t.Errorf("%s with MATCH_TLS_HOSTS=%t: %s %q, want matched %t", tt.host, tt.enabled, dns.RcodeToString[r.Rcode], rdata(r.Answer), tt.matched)
+		}
+	}
+
+	// A host listed under both rules and TLS is still served once.
+	s := newTestServer(t, map[string]string{"MATCH_TLS_HOSTS": "true"}, ingress)
+	if hosts := s.servedHosts([]*networkingv1.Ingress{ingress}); len(hosts) != 3 {
+		t.Errorf("servedHosts = %v, want 3 hosts", hosts)
+	}
+}
+
+func TestCNAMEChase(t *testing.T) {
+	var chased atomic.Int64
+	upstream := startUpstream(t, counted(&chased, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name != "lb.example.net." {
+			rcodeWith(dns.RcodeNameError)(w, r)
+			return
+		}
+		switch r.Question[0].Qtype {
+		case dns.TypeA:
+			answerWith("A 192.0.2.7", "A 192.0.2.8")(w, r)
+		case dns.TypeAAAA:
+			answerWith("AAAA 2001:db8::7")(w, r)
+		default:
+			answerWith()(w, r)
+		}
+	}))
+	ingress := withStatus(newIngress("app", "app.example.com"), "lb.example.net")
+	s := newTestServer(t, fallbackEnv(upstream), ingress)
+	tests := []struct {
+		qtype  uint16
+		answer []string
+	}{
+		{dns.TypeA, []string{"CNAME lb.example.net.", "A 192.0.2.7", "A 192.0.2.8"}},
+		{dns.TypeAAAA, []string{"CNAME lb.example.net.", "AAAA 2001:db8::7"}},
+		{dns.TypeMX, []string{"CNAME lb.example.net."}},
+	}
+	for _, tt := range tests {
+		r := query(t, s, "app.example.com", tt.qtype)
+		if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+			t.Errorf("%s: answer = %q, want %q", dns.Type(tt.qtype), got, tt.answer)
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s: rcode = %s, want NOERROR", dns.Type(tt.qtype), dns.RcodeToString[r.Rcode])
+		}
+	}
+	if n := chased.Load(); n != 3 {
+		t.Errorf("upstream got %d queries, want one per type", n)
+	}
+
+	// The target's records are cached, whichever host points at it.
+	s.responses.flush()
+	query(t, s, "app.example.com", dns.TypeA)
+	other := newTestServer(t, fallbackEnv(upstream), ingress, withStatus(newIngress("other", "other.example.com"), "lb.example.net"))
+	other.responses = s.responses
+	if got := rdata(query(t, other, "other.example.com", dns.TypeA).Answer); len(got) != 3 {
+		t.Errorf("other.example.com: answer = %q, want the CNAME and both addresses", got)
+	}
+	if n := chased.Load(); n != 4 {
+		t.Errorf("upstream got %d queries, want the target's A records served from the cache", n)
+	}
+
+	// Without fallback only the CNAME is answered.
+	if got := rdata(query(t, newTestServer(t, nil, ingress), "app.example.com", dns.TypeA).Answer); !slices.Equal(got, []string{"CNAME lb.example.net."}) {
+		t.Errorf("without fallback: answer = %q, want the CNAME alone", got)
+	}
+}
+
+func TestCNAMEChaseTruncation(t *testing.T) {
+	records := make([]string, 60)
+	for i := range records {
+		records[i] = "A " + net.IPv4(192, 0, 2, byte(i+1)).String()
+	}
+	// The upstream truncates over UDP like a real one, so the target is
+	// looked up in full over TCP.
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, record := range records {
+			m.Answer = append(m.Answer, mustRR(t, r.Question[0].Name+" 300 IN "+record))
+		}
+		if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+			m.Truncate(dns.MinMsgSize)
+		}
+		w.WriteMsg(m)
+	})
+	s := newTestServer(t, fallbackEnv(upstream), withStatus(newIngress("app", "app.example.com"), "lb.example.net"))
+	r := query(t, s, "app.example.com", dns.TypeA)
+	if !r.Truncated {
+		t.Error("TC not set on a reply over 512 bytes")
+	}
+	if len(r.Answer) == 0 || r.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("truncated answer = %v, want it to keep the CNAME first", r.Answer)
+	}
+	if r := exchange(t, s, r.Copy().SetQuestion("app.example.com.", dns.TypeA), tcpClient); r.Truncated || len(r.Answer) != 61 {
+		t.Errorf("over TCP: TC %t and %d answers, want the CNAME and all %d addresses", r.Truncated, len(r.Answer), len(records))
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	queriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ingress_dns_queries_total",
+		Help: "Total number of DNS questions received, by query type.",
+	}, []string{"qtype"})
+	ingressMatchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ingress_dns_ingress_matches_total",
+		Help: "Number of DNS questions answered from an ingress.",
+	})
+	fallbackQueriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ingress_dns_fallback_queries_total",
+		Help: "Number of DNS questions forwarded to the fallback servers.",
+	})
+	fallbackFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ingress_dns_fallback_failures_total",
+		Help: "Number of forwarded DNS questions that no fallback server answered.",
+	})
+	fallbackRTT = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ingress_dns_fallback_rtt_seconds",
+		Help:    "Round trip time of exchanges with the fallback servers, by server.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"server"})
+	requestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ingress_dns_request_duration_seconds",
+		Help:    "Time taken to answer a DNS request.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+)
+
+// registerCacheMetrics exposes the size of the ingress cache, so a
+// reconcile gone wrong that drops ingresses can be alerted on. The gauges
+// are computed from the cache on every scrape.
+func registerCacheMetrics(s *Server) {
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ingress_dns_cached_ingresses",
+			Help: "Number of ingresses in the informer cache.",
+		}, func() float64 {
+			ingresses, _ := s.cachedIngresses()
+			return float64(len(ingresses))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ingress_dns_served_hosts",
+			Help: "Number of distinct hosts served from the cached ingresses.",
+		}, func() float64 {
+			ingresses, _ := s.cachedIngresses()
+			return float64(len(s.servedHosts(ingresses)))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ingress_dns_malformed_hosts",
+			Help: "Number of hosts in the cached ingresses skipped as malformed wildcards.",
+		}, func() float64 {
+			ingresses, _ := s.cachedIngresses()
+			return float64(s.malformedHosts(ingresses))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ingress_dns_wildcard_names",
+			Help: "Number of distinct names answered through wildcard matches over WILDCARD_WINDOW.",
+		}, func() float64 {
+			if s.wildcardNames == nil {
+				return 0
+			}
+			return float64(s.wildcardNames.count())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ingress_dns_cache_staleness_seconds",
+			Help: "Seconds since the ingress cache was last known to be in sync with the API server.",
+		}, func() float64 {
+			return s.staleness().Seconds()
+		}),
+	)
+}
+
+func startMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		slog.Info("Starting metrics server", "addr", server.Addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			slog.Error("Metrics server stopped", "err", err)
+		}
+	}()
+	return server
+}
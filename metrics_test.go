@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestFallbackRTT(t *testing.T) {
+	upstream := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(50 * time.Millisecond)
+		answerWith("A 192.0.2.1")(w, r)
+	})
+	s := newTestServer(t, fallbackEnv(upstream))
+	query(t, s, "forwarded.example.org", dns.TypeA)
+
+	var metric dto.Metric
+	if err := fallbackRTT.WithLabelValues(upstream).(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatalf("reading RTT histogram: %v", err)
+	}
+	h := metric.GetHistogram()
+	if h.GetSampleCount() != 1 || h.GetSampleSum() < 0.05 || h.GetSampleSum() > 1 {
+		t.Errorf("RTT histogram for %s has %d samples summing to %vs, want one of about 50ms", upstream, h.GetSampleCount(), h.GetSampleSum())
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	s := newTestServer(t, nil,
+		newIngress("a", "a.example.com", "b.example.com"),
+		newIngress("b", "b.example.com", "*.example.org", ""),
+		newIngress("c", "c.example.com"),
+	)
+	// A registry of its own lets the gauges be registered on every run.
+	registry := prometheus.NewRegistry()
+	defaultRegisterer := prometheus.DefaultRegisterer
+	prometheus.DefaultRegisterer = registry
+	t.Cleanup(func() { prometheus.DefaultRegisterer = defaultRegisterer })
+	registerCacheMetrics(s)
+
+	expected := `
+# HELP ingress_dns_cached_ingresses Number of ingresses in the informer cache.
+# TYPE ingress_dns_cached_ingresses gauge
+ingress_dns_cached_ingresses 3
+# HELP ingress_dns_served_hosts Number of distinct hosts served from the cached ingresses.
+# TYPE ingress_dns_served_hosts gauge
+ingress_dns_served_hosts 4
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected),
+		"ingress_dns_cached_ingresses", "ingress_dns_served_hosts"); err != nil {
+		t.Error(err)
+	}
+}
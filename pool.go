@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxIdleConns is how many idle connections are kept per fallback server.
+	maxIdleConns = 4
+	// maxIdleTime is how long an idle connection is kept. Public resolvers
+	// close idle TCP connections after about ten seconds.
+	maxIdleTime = 5 * time.Second
+)
+
+type idleConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+// connPool keeps idle TCP and DNS-over-TLS connections to the fallback
+// servers, so forwarded queries don't pay for a handshake each time.
+type connPool struct {
+	mu   sync.Mutex
+	idle map[string][]idleConn
+}
+
+func newConnPool() *connPool {
+	return &connPool{idle: make(map[string][]idleConn)}
+}
+
+// get returns the most recently used idle connection for key, or nil.
+// Connections idle for too long are closed.
+func (p *connPool) get(key string) *dns.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conns := p.idle[key]
+	for len(conns) > 0 {
+		last := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if time.Since(last.since) < maxIdleTime {
+			p.idle[key] = conns
+			return last.conn
+		}
+		last.conn.Close()
+	}
+	delete(p.idle, key)
+	return nil
+}
+
+// put returns a healthy connection for key to the pool, closing it if the
+// pool is full.
+func (p *connPool) put(key string, conn *dns.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle[key]) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	p.idle[key] = append(p.idle[key], idleConn{conn: conn, since: time.Now()})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// pipeConn returns a dns.Conn over one end of an in-memory pipe.
+func pipeConn(t testing.TB) *dns.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	return &dns.Conn{Conn: client}
+}
+
+func TestConnPool(t *testing.T) {
+	p := newConnPool()
+	if conn := p.get("tcp/a"); conn != nil {
+		t.Fatalf("get from an empty pool = %v, want nil", conn)
+	}
+
+	conns := make([]*dns.Conn, maxIdleConns+1)
+	for i := range conns {
+		conns[i] = pipeConn(t)
+		p.put("tcp/a", conns[i])
+	}
+	// The connection put into a full pool is closed, the most recently used
+	// of the others is handed out first.
+	if _, err := conns[maxIdleConns].Write([]byte{0}); err == nil {
+		t.Error("connection beyond maxIdleConns wasn't closed")
+	}
+	for i := maxIdleConns - 1; i >= 0; i-- {
+		if conn := p.get("tcp/a"); conn != conns[i] {
+			t.Fatalf("get = %p, want connection %d (%p)", conn, i, conns[i])
+		}
+	}
+	if conn := p.get("tcp/b"); conn != nil {
+		t.Errorf("get for another server = %v, want nil", conn)
+	}
+
+	stale := pipeConn(t)
+	p.put("tcp/a", stale)
+	p.idle["tcp/a"][0].since = time.Now().Add(-maxIdleTime)
+	if conn := p.get("tcp/a"); conn != nil {
+		t.Errorf("get = %v, want the expired connection dropped", conn)
+	}
+	if _, err := stale.Write([]byte{0}); err == nil {
+		t.Error("expired connection wasn't closed")
+	}
+}
+
+func TestFallbackReusesConnections(t *testing.T) {
+	upstream := startUpstream(t, answerWith("A 192.0.2.1"))
+	env := fallbackEnv(upstream)
+	env["FALLBACK_NET"] = "tcp"
+	s := newTestServer(t, env)
+	for _, name := range []string{"one.example.org", "two.example.org"} {
+		if got := rdata(query(t, s, name, dns.TypeA).Answer); len(got) != 1 {
+			t.Fatalf("%s: answer = %q, want the upstream's", name, got)
+		}
+		if idle := len(s.conns.idle["tcp/"+upstream]); idle != 1 {
+			t.Errorf("after %s: %d idle connections, want the one reused", name, idle)
+		}
+	}
+
+	// A connection the server has closed is redialled.
+	conn := s.conns.get("tcp/" + upstream)
+	conn.Close()
+	s.conns.put("tcp/"+upstream, conn)
+	if got := rdata(query(t, s, "three.example.org", dns.TypeA).Answer); len(got) != 1 {
+		t.Errorf("over a closed connection: answer = %q, want the upstream's", got)
+	}
+}
+
+func BenchmarkExchangeTCP(b *testing.B) {
+	upstream := startUpstream(b, answerWith("A 192.0.2.1"))
+	s := newTestServer(b, nil)
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeA)
+	c := &dns.Client{Net: "tcp", Timeout: time.Second}
+
+	b.Run("dial per query", func(b *testing.B) {
+		for range b.N {
+			if _, _, err := c.Exchange(msg, upstream); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		for range b.N {
+			if _, _, err := s.exchangeClient(context.Background(), c, msg, upstream); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
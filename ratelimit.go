@@ -0,0 +1,61 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+type limiterEntry struct {
+	key     string
+	limiter *rate.Limiter
+}
+
+// rateLimiter keeps a token bucket per client address. Only the most
+// recently seen clients are tracked so memory stays bounded.
+type rateLimiter struct {
+	mu    sync.Mutex
+	limit rate.Limit
+	burst int
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newRateLimiter(qps float64, burst, size int) *rateLimiter {
+	return &rateLimiter{
+		limit: rate.Limit(qps),
+		burst: burst,
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// allow reports whether the client may be served now. A nil limiter allows
+// everything.
+func (l *rateLimiter) allow(ip net.IP) bool {
+	if l == nil || ip == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ip.String()
+	if elem, ok := l.items[key]; ok {
+		l.order.MoveToFront(elem)
+		return elem.Value.(*limiterEntry).limiter.Allow()
+	}
+
+	entry := &limiterEntry{key: key, limiter: rate.NewLimiter(l.limit, l.burst)}
+	l.items[key] = l.order.PushFront(entry)
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*limiterEntry).key)
+	}
+	return entry.limiter.Allow()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimit(t *testing.T) {
+	s := newTestServer(t, map[string]string{"RATE_LIMIT": "1", "RATE_BURST": "5"}, newIngress("app", "app.example.com"))
+
+	refused := 0
+	for range 10 {
+		if query(t, s, "app.example.com", dns.TypeA).Rcode == dns.RcodeRefused {
+			refused++
+		}
+	}
+	if refused < 4 || refused > 5 {
+		t.Errorf("refused %d of a burst of 10 with RATE_BURST=5, want the excess 5", refused)
+	}
+
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 11), Port: 5353}
+	req := new(dns.Msg)
+	req.SetQuestion("app.example.com.", dns.TypeA)
+	if r := exchange(t, s, req, other); r.Rcode != dns.RcodeSuccess {
+		t.Errorf("other client: rcode = %s, want NOERROR", dns.RcodeToString[r.Rcode])
+	}
+}
+
+func TestRateLimiterEvictsClients(t *testing.T) {
+	l := newRateLimiter(1, 1, 2)
+	a, b, c := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2), net.IPv4(192, 0, 2, 3)
+	for _, ip := range []net.IP{a, b, c} {
+		if !l.allow(ip) {
+			t.Errorf("first query from %s refused", ip)
+		}
+	}
+	if !l.allow(a) {
+		t.Error("evicted client refused, want a fresh bucket")
+	}
+	if l.allow(c) {
+		t.Error("client over its burst allowed")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"sigs.k8s.io/yaml"
+)
+
+// configFile is an optional CONFIG_FILE in YAML, mapping the environment
+// variable names to their values, as an alternative to setting them all on
+// the container:
+//
+//	INGRESS_IP: 10.0.0.1
+//	FALLBACK_DNS: [1.1.1.1:53, 8.8.8.8:53]
+//	ZONE_FORWARDERS:
+//	  internal.corp: [10.0.0.53:53, 10.0.0.54:53]
+//
+// Lists are joined with commas and maps into key=value entries, one per item
+// for a key mapped to a list, so the file
+// goes through the same parsing and validation as the environment. Variables
+// set in the environment take precedence over the file. As the environment
+// of a running process can't be changed from outside, the file is what a
+// SIGHUP reload picks changes up from.
+type configFile struct {
+	path string
+	// base is the environment the process started with.
+	base    map[string]bool
+	applied map[string]string
+}
+
+func newConfigFile(path string) *configFile {
+	base := make(map[string]bool)
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		base[key] = true
+	}
+	return &configFile{path: path, base: base}
+}
+
+// apply sets the variables from the file that the process wasn't started
+// with in the environment, and unsets those dropped from the file since the
+// last apply.
+func (f *configFile) apply() error {
+	if f.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	values := make(map[string]string, len(doc))
+	for key, value := range doc {
+		if f.base[key] {
+			continue
+		}
+		if values[key], err = configValue(value); err != nil {
+			return fmt.Errorf("%s: %s: %w", f.path, key, err)
+		}
+	}
+
+	for key := range f.applied {
+		if _, ok := values[key]; !ok {
+			os.Unsetenv(key)
+		}
+	}
+	for key, value := range values {
+		os.Setenv(key, value)
+	}
+	f.applied = values
+	return nil
+}
+
+// configValue formats a YAML value the way the environment variable holding
+// it would be written.
+func configValue(value any) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case []any:
+		items := make([]string, len(value))
+		for i, item := range value {
+			var err error
+			if items[i], err = configValue(item); err != nil {
+				return "", err
+			}
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		// Keys are sorted, but a key's list keeps its order.
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		var items []string
+		for _, key := range keys {
+			values, ok := value[key].([]any)
+			if !ok {
+				values = []any{value[key]}
+			}
+			for _, item := range values {
+				text, err := configValue(item)
+				if err != nil {
+					return "", err
+				}
+				items = append(items, key+"="+text)
+			}
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// reloadConfig re-reads the configuration and swaps it in for the queries
+// that follow, and empties the response cache so no answer built from the
+// old one is served. Settings used to set up the listeners, informers and
+// background workers at startup, such as the ports, WATCH_NAMESPACES,
+// WATCH_SERVICES, STATIC_HOSTS, STALE_AFTER and RATE_LIMIT, only change on
+// restart.
+func (s *Server) reloadConfig(file *configFile) error {
+	if err := file.apply(); err != nil {
+		return err
+	}
+	next, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	// The informers keep serving the namespaces and kinds they were started
+	// with, so listing must keep to them as well, and the cache is only
+	// checked for staleness if it was at startup.
+	current := s.config()
+	next.WatchNamespaces, next.WatchServices = current.WatchNamespaces, current.WatchServices
+	next.StaleAfter = current.StaleAfter
+
+	initLogger(next)
+	s.cfg.Store(next)
+	s.responses.reset(next.CacheSize, next.NegativeTTL)
+	return nil
+}
+
+// watchReload reloads the configuration on every SIGHUP. A configuration
+// that fails to load keeps the current one in place.
+func (s *Server) watchReload(file *configFile, stopCh <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-hup:
+		}
+
+		if err := s.reloadConfig(file); err != nil {
+			slog.Error("Failed to reload configuration, keeping the current one", "err", err)
+			continue
+		}
+		slog.Info("Reloaded configuration")
+	}
+}
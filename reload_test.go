@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeConfigFile writes a CONFIG_FILE with contents, replacing any
+// previous one at path.
+func writeConfigFile(t testing.TB, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+}
+
+// unsetenv unsets the variables a config file may set for the rest of the
+// test, restoring them when it ends.
+func unsetenv(t testing.TB, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	unsetenv(t, "DNS_TTL", "UNMATCHED_RCODE", "FALLBACK_STRATEGY")
+	// reloadConfig installs a logger of its own.
+	logger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(logger) })
+	t.Setenv("LOG_LEVEL", "error")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, "DNS_TTL: 30\n")
+	s := newTestServer(t, nil, newIngress("app", "app.example.com"))
+	file := newConfigFile(path)
+	if err := s.reloadConfig(file); err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+	check := func(ttl uint32, rcode int) {
+		t.Helper()
+		if r := query(t, s, "app.example.com", dns.TypeA); len(r.Answer) != 1 || r.Answer[0].Header().Ttl != ttl {
+			t.Errorf("answer = %v, want one with TTL %d", r.Answer, ttl)
+		}
+		if r := query(t, s, "missing.example.org", dns.TypeA); r.Rcode != rcode {
+			t.Errorf("unmatched rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[rcode])
+		}
+	}
+	check(30, dns.RcodeNameError)
+
+	// The cached answer goes with the configuration it was built from.
+	writeConfigFile(t, path, "DNS_TTL: 90\nUNMATCHED_RCODE: REFUSED\n")
+	if err := s.reloadConfig(file); err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+	check(90, dns.RcodeRefused)
+
+	writeConfigFile(t, path, "DNS_TTL: 60\nFALLBACK_STRATEGY: random\n")
+	if err := s.reloadConfig(file); err == nil {
+		t.Error("reloading an invalid configuration succeeded, want an error")
+	}
+	check(90, dns.RcodeRefused)
+
+	// Settings dropped from the file go back to their defaults.
+	writeConfigFile(t, path, "{}\n")
+	if err := s.reloadConfig(file); err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+	check(30, dns.RcodeNameError)
+}
+
+func TestReloadKeepsStartupSettings(t *testing.T) {
+	unsetenv(t, "WATCH_NAMESPACES", "STALE_AFTER")
+	logger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(logger) })
+	t.Setenv("LOG_LEVEL", "error")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, "WATCH_NAMESPACES: [default]\n")
+	s := newTestServer(t, nil)
+	writeConfigFile(t, path, "WATCH_NAMESPACES: [default, other]\nSTALE_AFTER: 1m\n")
+	if err := s.reloadConfig(newConfigFile(path)); err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+	if got := s.config().WatchNamespaces; got != nil {
+		t.Errorf("WatchNamespaces = %v after reload, want the startup value", got)
+	}
+	if got := s.config().StaleAfter; got != 0 {
+		t.Errorf("StaleAfter = %s after reload, want the startup value", got)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	keys := []string{"DNS_TTL", "FALLBACK_DNS", "ZONE_FORWARDERS", "MAINTENANCE_HOSTS", "WILDCARD_MULTILEVEL", "QUERY_TIMEOUT", "ZONE", "SOA_RNAME"}
+	unsetenv(t, keys...)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, `
+DNS_TTL: 120
+FALLBACK_DNS: [9.9.9.9:53, "8.8.8.8:53"]
+ZONE_FORWARDERS:
+  internal.corp: [10.0.0.53:53, 10.0.0.52:53]
+  lab: 10.0.0.54:53
+MAINTENANCE_HOSTS:
+  app.example.com:
+    - 10.0.0.7
+    - 10.0.0.8
+  db.example.com: 10.0.0.9
+WILDCARD_MULTILEVEL: true
+QUERY_TIMEOUT: 3s
+ZONE: example.com
+INGRESS_IP: 10.9.9.9
+`)
+	// The environment takes precedence over the file.
+	t.Setenv("ZONE", "example.net")
+	t.Setenv("INGRESS_IP", "10.0.0.1")
+
+	if err := newConfigFile(path).apply(); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.DNSTTL != 120 {
+		t.Errorf("DNSTTL = %d, want 120", cfg.DNSTTL)
+	}
+	if want := []string{"9.9.9.9:53", "8.8.8.8:53"}; !slices.Equal(cfg.FallbackDNS, want) {
+		t.Errorf("FallbackDNS = %v, want %v", cfg.FallbackDNS, want)
+	}
+	if want := map[string][]string{"internal.corp.": {"10.0.0.53:53", "10.0.0.52:53"}, "lab.": {"10.0.0.54:53"}}; !reflect.DeepEqual(cfg.ZoneForwarders, want) {
+		t.Errorf("ZoneForwarders = %v, want %v", cfg.ZoneForwarders, want)
+	}
+	if want := map[string][]string{"app.example.com.": {"10.0.0.7", "10.0.0.8"}, "db.example.com.": {"10.0.0.9"}}; !reflect.DeepEqual(cfg.MaintenanceHosts, want) {
+		t.Errorf("MaintenanceHosts = %v, want %v", cfg.MaintenanceHosts, want)
+	}
+	if !cfg.WildcardMultiLevel {
+		t.Error("WildcardMultiLevel = false, want true")
+	}
+	if cfg.QueryTimeout != 3*time.Second {
+		t.Errorf("QueryTimeout = %s, want 3s", cfg.QueryTimeout)
+	}
+	if want := []string{"example.net."}; !slices.Equal(cfg.Zones, want) {
+		t.Errorf("Zones = %v, want %v from the environment", cfg.Zones, want)
+	}
+	if want := []string{"10.0.0.1"}; !slices.Equal(cfg.IngressIPs, want) {
+		t.Errorf("IngressIPs = %v, want %v from the environment", cfg.IngressIPs, want)
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	unsetenv(t, "DNS_TTL", "FALLBACK_STRATEGY")
+	dir := t.TempDir()
+	if err := newConfigFile(filepath.Join(dir, "missing.yaml")).apply(); !os.IsNotExist(err) {
+		t.Errorf("applying a missing file: error = %v, want not exist", err)
+	}
+	if err := newConfigFile("").apply(); err != nil {
+		t.Errorf("applying no file: %v", err)
+	}
+
+	for _, contents := range []string{
+		"DNS_TTL: [30\n",
+		"- DNS_TTL\n",
+	} {
+		path := filepath.Join(dir, "invalid.yaml")
+		writeConfigFile(t, path, contents)
+		if err := newConfigFile(path).apply(); err == nil {
+			t.Errorf("applying %q succeeded, want an error", contents)
+		}
+	}
+
+	// Values are validated as if they came from the environment.
+	path := filepath.Join(dir, "config.yaml")
+	writeConfigFile(t, path, "FALLBACK_STRATEGY: random\n")
+	if err := newConfigFile(path).apply(); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig with FALLBACK_STRATEGY=random from the file succeeded, want an error")
+	}
+}
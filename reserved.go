@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// answerReserved answers the special-use names of RFC 6761 that must not
+// be matched against the ingresses or forwarded, and reports whether name
+// was one of them. The root is refused, as this is not a root server;
+// localhost and its subdomains are the loopback addresses, and the loopback
+// addresses point back to localhost.
+func (s *Server) answerReserved(m *dns.Msg, q dns.Question) bool {
+	if !reservedName(q.Name) {
+		return false
+	}
+	name := dns.CanonicalName(q.Name)
+	switch {
+	case name == ".":
+		m.Rcode = dns.RcodeRefused
+	case isLocalhost(name):
+		s.answerStatic(m, q, []string{"127.0.0.1", "::1"})
+	case q.Qtype == dns.TypePTR:
+		m.Answer = append(m.Answer, s.newPTR(q.Name, "localhost"))
+	}
+	return true
+}
+
+// reservedName reports whether name is one of the special-use names
+// answerReserved answers.
+func reservedName(name string) bool {
+	name = dns.CanonicalName(name)
+	if name == "." || isLocalhost(name) {
+		return true
+	}
+	ip := parseReverseName(strings.TrimSuffix(name, "."))
+	return ip != nil && ip.IsLoopback()
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost." || strings.HasSuffix(name, ".localhost.")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReservedNames(t *testing.T) {
+	var forwarded atomic.Int64
+	upstream := startUpstream(t, counted(&forwarded, answerWith("A 192.0.2.1")))
+	// A catch-all ingress and fallback would answer anything that reached
+	// them.
+	env := fallbackEnv(upstream)
+	env["MATCH_EMPTY_HOST"] = "true"
+	s := newTestServer(t, env, newIngress("catch-all", ""), newIngress("wildcard", "*.localhost"))
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		answer []string
+	}{
+		{".", dns.TypeA, dns.RcodeRefused, nil},
+		{".", dns.TypeNS, dns.RcodeRefused, nil},
+		{"localhost", dns.TypeA, dns.RcodeSuccess, []string{"A 127.0.0.1"}},
+		{"LocalHost", dns.TypeAAAA, dns.RcodeSuccess, []string{"AAAA ::1"}},
+		{"app.localhost", dns.TypeA, dns.RcodeSuccess, []string{"A 127.0.0.1"}},
+		{"localhost", dns.TypeMX, dns.RcodeSuccess, nil},
+		{"1.0.0.127.in-addr.arpa", dns.TypePTR, dns.RcodeSuccess, []string{"PTR localhost."}},
+		{"1.2.3.127.in-addr.arpa", dns.TypePTR, dns.RcodeSuccess, []string{"PTR localhost."}},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa", dns.TypePTR, dns.RcodeSuccess, []string{"PTR localhost."}},
+	}
+	for _, tt := range tests {
+		r := query(t, s, tt.name, tt.qtype)
+		if got := rdata(r.Answer); r.Rcode != tt.rcode || !slices.Equal(got, tt.answer) {
+			t.Errorf("%s %s: %s %q, want %s %q", tt.name, dns.Type(tt.qtype), dns.RcodeToString[r.Rcode], got, dns.RcodeToString[tt.rcode], tt.answer)
+		}
+	}
+	if n := forwarded.Load(); n != 0 {
+		t.Errorf("forwarded %d reserved queries, want none", n)
+	}
+
+	// Names that merely look alike are answered as usual.
+	if got := rdata(query(t, s, "localhost.example.com", dns.TypeA).Answer); !slices.Equal(got, []string{"A 10.0.0.1"}) {
+		t.Errorf("localhost.example.com: answer = %q, want the catch-all's [A 10.0.0.1]", got)
+	}
+}
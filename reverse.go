@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+// matchReverse returns the exact ingress hosts that resolve to the address
+// encoded in the in-addr.arpa or ip6.arpa name, if that address is ours.
+func (s *Server) matchReverse(ingresses []*networkingv1.Ingress, name string) []string {
+	ip := parseReverseName(name)
+	if ip == nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, ingress := range ingresses {
+		if !s.matchIngressClass(ingress) || !s.matchIngressAnnotation(ingress) {
+			continue
+		}
+		for _, host := range s.ingressHosts(ingress) {
+			host := canonicalHost(host)
+			if host == "" || wildcardRegex.MatchString(host) || seen[host] {
+				continue
+			}
+			if slices.ContainsFunc(s.ingressAddresses(s.newIngressMatch(ingress, host)), ip.Equal) {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	slices.Sort(hosts)
+	return hosts
+}
+
+// ingressAddresses lists the addresses a matched host is answered with,
+// mirroring ingressRecords.
+func (s *Server) ingressAddresses(match ingressMatch) []net.IP {
+	values := match.IPs
+	if ips, ok := s.config().MaintenanceHosts[match.Name]; ok {
+		values = ips
+	}
+	switch {
+	case len(values) > 0:
+	case match.Hostname != "":
+		return nil
+	case s.config().IngressHostname != "":
+		if ips := s.ingressHostIPs.Load(); ips != nil {
+			values = *ips
+		}
+	default:
+		values = append(slices.Clone(s.config().IngressIPs), s.config().IngressIPv6s...)
+	}
+
+	var ips []net.IP
+	for _, value := range values {
+		if ip := net.ParseIP(value); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// hasAddress reports whether a matched host can be answered at all: with a
+// CNAME, or with an address that isn't unspecified such as the 0.0.0.0
+// INGRESS_IP defaults to without a POD_IP.
+func (s *Server) hasAddress(match ingressMatch) bool {
+	_, maintained := s.config().MaintenanceHosts[match.Name]
+	if !maintained && len(match.IPs) == 0 && (match.Hostname != "" || s.config().IngressHostname != "") {
+		return true
+	}
+	return slices.ContainsFunc(s.ingressAddresses(match), func(ip net.IP) bool {
+		return !ip.IsUnspecified()
+	})
+}
+
+// parseReverseName turns an in-addr.arpa or ip6.arpa name (without the
+// trailing dot) back into the address it encodes, or nil if it doesn't
+// encode a complete address.
+func parseReverseName(name string) net.IP {
+	name = strings.ToLower(name)
+	if prefix, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		labels := strings.Split(prefix, ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		slices.Reverse(labels)
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+	if prefix, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		labels := strings.Split(prefix, ".")
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i := range ip {
+			hi, err1 := strconv.ParseUint(labels[len(labels)-1-2*i], 16, 4)
+			lo, err2 := strconv.ParseUint(labels[len(labels)-2-2*i], 16, 4)
+			if err1 != nil || err2 != nil {
+				return nil
+			}
+			ip[i] = byte(hi<<4 | lo)
+		}
+		return ip
+	}
+	return nil
+}
+
+func (s *Server) newPTR(name, host string) dns.RR {
+	return &dns.PTR{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: s.config().DNSTTL},
+		Ptr: dns.Fqdn(host),
+	}
+}
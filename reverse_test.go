@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReverseQueries(t *testing.T) {
+	upstream := startUpstream(t, answerWith("PTR forwarded.example.org."))
+	s := newTestServer(t, fallbackEnv(upstream),
+		withStatus(newIngress("app", "app.example.com", "www.example.com"), "10.0.0.2", "2001:db8::2"),
+		withStatus(newIngress("wildcard", "*.example.com"), "10.0.0.2"),
+		newIngress("default-ip", "default.example.com"),
+	)
+	tests := []struct {
+		name string
+		ip   string
+		ptrs []string
+	}{
+		{"IPv4 status", "10.0.0.2", []string{"PTR app.example.com.", "PTR www.example.com."}},
+		{"IPv6 status", "2001:db8::2", []string{"PTR app.example.com.", "PTR www.example.com."}},
+		{"INGRESS_IP", "10.0.0.1", []string{"PTR default.example.com."}},
+		{"not ours", "192.0.2.1", []string{"PTR forwarded.example.org."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, err := dns.ReverseAddr(tt.ip)
+			if err != nil {
+				t.Fatalf("ReverseAddr(%s): %v", tt.ip, err)
+			}
+			if got := rdata(query(t, s, name, dns.TypePTR).Answer); !slices.Equal(got, tt.ptrs) {
+				t.Errorf("answer = %q, want %q", got, tt.ptrs)
+			}
+		})
+	}
+}
+
+func TestParseReverseName(t *testing.T) {
+	tests := []struct {
+		name string
+		want net.IP
+	}{
+		{"2.0.0.10.in-addr.arpa", net.ParseIP("10.0.0.2")},
+		{"2.0.0.10.IN-ADDR.ARPA", net.ParseIP("10.0.0.2")},
+		{"0.0.10.in-addr.arpa", nil},
+		{"256.0.0.10.in-addr.arpa", nil},
+		{"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", net.ParseIP("2001:db8::2")},
+		{"2.0.0.0.ip6.arpa", nil},
+		{"example.com", nil},
+	}
+	for _, tt := range tests {
+		if got := parseReverseName(tt.name); !got.Equal(tt.want) {
+			t.Errorf("parseReverseName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
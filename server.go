@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/singleflight"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+)
+
+// Server answers DNS queries from the ingresses it watches. Everything a
+// query needs hangs off it, so tests can build one around fake listers or a
+// fake clientset instead of a cluster.
+type Server struct {
+	// cfg is the active configuration, swapped as a whole by reloadConfig.
+	cfg atomic.Pointer[Config]
+	// kubeClient is used to start the informers and, until their cache has
+	// synced, to list ingresses directly. It may be nil when the listers are
+	// provided by the caller.
+	kubeClient kubernetes.Interface
+
+	ingressListers []networkinglisters.IngressLister
+	serviceListers []corelisters.ServiceLister
+	// ingressClassLister caches the cluster-scoped IngressClass resources so
+	// INGRESS_CLASS can also name a controller. It is only set when
+	// INGRESS_CLASS is.
+	ingressClassLister networkinglisters.IngressClassLister
+	// cacheSynced is set once the informers have completed their first list
+	// against the API server.
+	cacheSynced atomic.Bool
+	// lastSync is when, in Unix nanoseconds, the cache was last known to be
+	// in sync with the API server, for STALE_AFTER.
+	lastSync atomic.Int64
+	// informers tracks the watch health of every informer started.
+	informers []*informerHealth
+	// draining is set during SHUTDOWN_DELAY to fail /readyz while queries
+	// are still answered.
+	draining atomic.Bool
+	// snapshot holds the ingresses loaded from SNAPSHOT_PATH, served until
+	// the cache has synced when the API server can't be listed.
+	snapshot atomic.Pointer[[]*networkingv1.Ingress]
+
+	// staticHosts maps lowercase FQDNs to the addresses listed for them in
+	// the STATIC_HOSTS file.
+	staticHosts atomic.Pointer[map[string][]string]
+	// ingressHostIPs are the resolved addresses of the INGRESS_IP hostname,
+	// nil until it has been resolved.
+	ingressHostIPs atomic.Pointer[[]string]
+	// lookupHost resolves the INGRESS_IP hostname.
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	// matchPatterns caches the compiled matchAnnotation patterns, nil for
+	// the invalid ones.
+	matchPatterns sync.Map
+	// malformedSeen holds the namespace/ingress/host keys of the malformed
+	// wildcard hosts already warned about.
+	malformedSeen sync.Map
+
+	responses     *responseCache
+	limiter       *rateLimiter
+	fallbackGroup singleflight.Group
+	conns         *connPool
+	// wildcardNames counts the distinct names answered through wildcard
+	// matches over WILDCARD_WINDOW.
+	wildcardNames *nameWindow
+	rotation      atomic.Uint64
+}
+
+// newServer creates a Server for cfg. The listers are filled in by
+// initIngressInformer, or directly by the caller.
+func newServer(cfg *Config, kubeClient kubernetes.Interface) *Server {
+	s := &Server{
+		kubeClient: kubeClient,
+		responses:  newResponseCache(cfg.CacheSize, cfg.NegativeTTL),
+		lookupHost: net.DefaultResolver.LookupHost,
+		conns:      newConnPool(),
+	}
+	if cfg.WildcardWindow > 0 {
+		s.wildcardNames = newNameWindow(cfg.WildcardWindow)
+	}
+	s.cfg.Store(cfg)
+	if cfg.RateLimit > 0 {
+		s.limiter = newRateLimiter(cfg.RateLimit, cfg.RateBurst, cfg.RateLimitClients)
+	}
+	return s
+}
+
+// config returns the active configuration. Callers that read several
+// settings for one decision should hold on to the result, so a reload in
+// between can't mix the old and new values.
+func (s *Server) config() *Config {
+	return s.cfg.Load()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// hostnameAnnotation lists the comma-separated hostnames a LoadBalancer
+// service is served under when WATCH_SERVICES is set.
+const hostnameAnnotation = "ingress-dns/hostname"
+
+func (s *Server) fetchServices() ([]*corev1.Service, error) {
+	var services []*corev1.Service
+	for _, lister := range s.serviceListers {
+		list, err := lister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, list...)
+	}
+	return services, nil
+}
+
+// matchName matches name against the ingresses and, with WATCH_SERVICES,
+// against the annotated LoadBalancer services. Ingresses take precedence.
+// A name that matches nothing is tried again without a STRIP_SUFFIX
+// suffix, such as a search domain appended by the client's resolver.
+func (s *Server) matchName(ingresses []*networkingv1.Ingress, name string) ([]ingressMatch, error) {
+	confirmed, err := s.matchHost(ingresses, name)
+	if err == nil {
+		return confirmed, nil
+	}
+	for _, suffix := range s.config().StripSuffixes {
+		if prefix, ok := strings.CutSuffix(dns.CanonicalName(name), "."+suffix); ok && prefix != "" {
+			return s.matchHost(ingresses, prefix)
+		}
+	}
+	return nil, err
+}
+
+func (s *Server) matchHost(ingresses []*networkingv1.Ingress, name string) ([]ingressMatch, error) {
+	confirmed, err := s.matchIngress(ingresses, name)
+	if !s.config().WatchServices || err == nil {
+		return confirmed, err
+	}
+
+	services, serr := s.fetchServices()
+	if serr != nil {
+		slog.Warn("Failed to fetch services", "name", name, "err", serr)
+		return nil, err
+	}
+	if confirmed = s.matchServices(services, name); len(confirmed) == 0 {
+		return nil, errNoMatch
+	}
+	return confirmed, nil
+}
+
+func (s *Server) matchServices(services []*corev1.Service, name string) []ingressMatch {
+	name = dns.CanonicalName(name)
+
+	for _, service := range services {
+		if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+		for _, host := range strings.Split(service.Annotations[hostnameAnnotation], ",") {
+			host = canonicalHost(host)
+			if host == "" {
+				continue
+			}
+			wildcard := name != host
+			if wildcard && !s.matchWildcard(host, name) {
+				continue
+			}
+			return []ingressMatch{s.newServiceMatch(service, name, host, wildcard)}
+		}
+	}
+	return nil
+}
+
+func (s *Server) newServiceMatch(service *corev1.Service, name, host string, wildcard bool) ingressMatch {
+	match := ingressMatch{
+		Name:      dns.Fqdn(name),
+		Namespace: service.Namespace,
+		Service:   service.Name,
+		Rule:      host,
+		Wildcard:  wildcard,
+		TTL:       s.annotatedTTL(service.Annotations),
+		TXT:       annotatedTXT(service.Annotations),
+	}
+	for _, lb := range service.Status.LoadBalancer.Ingress {
+		if lb.IP != "" {
+			match.IPs = append(match.IPs, lb.IP)
+		} else if lb.Hostname != "" && match.Hostname == "" {
+			match.Hostname = lb.Hostname
+		}
+	}
+	return match
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// newService builds a service of type in the default namespace served
+// under hosts, with a load balancer status of addresses.
+func newService(name string, serviceType corev1.ServiceType, hosts string, addresses ...string) *corev1.Service {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Annotations: map[string]string{hostnameAnnotation: hosts}},
+		Spec:       corev1.ServiceSpec{Type: serviceType},
+	}
+	for _, address := range addresses {
+		lb := corev1.LoadBalancerIngress{IP: address}
+		if net.ParseIP(address) == nil {
+			lb = corev1.LoadBalancerIngress{Hostname: address}
+		}
+		service.Status.LoadBalancer.Ingress = append(service.Status.LoadBalancer.Ingress, lb)
+	}
+	return service
+}
+
+func TestServiceHosts(t *testing.T) {
+	services := []*corev1.Service{
+		newService("ip", corev1.ServiceTypeLoadBalancer, "svc.example.com, other.example.com", "10.0.0.9"),
+		newService("hostname", corev1.ServiceTypeLoadBalancer, "elb.example.com", "lb.example.net"),
+		newService("wildcard", corev1.ServiceTypeLoadBalancer, "*.svc.example.org", "10.0.0.10"),
+		newService("internal", corev1.ServiceTypeClusterIP, "internal.example.com", "10.0.0.11"),
+		newService("shadowed", corev1.ServiceTypeLoadBalancer, "app.example.com", "10.0.0.12"),
+	}
+	tests := []struct {
+		name   string
+		watch  string
+		rcode  int
+		answer []string
+	}{
+		{"svc.example.com", "true", dns.RcodeSuccess, []string{"A 10.0.0.9"}},
+		{"other.example.com", "true", dns.RcodeSuccess, []string{"A 10.0.0.9"}},
+		{"elb.example.com", "true", dns.RcodeSuccess, []string{"CNAME lb.example.net."}},
+		{"a.svc.example.org", "true", dns.RcodeSuccess, []string{"A 10.0.0.10"}},
+		{"internal.example.com", "true", dns.RcodeNameError, nil},
+		{"app.example.com", "true", dns.RcodeSuccess, []string{"A 10.0.0.2"}},
+		{"svc.example.com", "false", dns.RcodeNameError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/watch="+tt.watch, func(t *testing.T) {
+			env := map[string]string{"WATCH_SERVICES": tt.watch, "CHASE_CNAME": "false"}
+			s := newTestServer(t, env, withStatus(newIngress("app", "app.example.com"), "10.0.0.2"))
+			s.serviceListers = []corelisters.ServiceLister{corelisters.NewServiceLister(newIndexer(t, services...))}
+
+			r := query(t, s, tt.name, dns.TypeA)
+			if r.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %q, want %q", got, tt.answer)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// loadSnapshot reads the ingresses saved by saveSnapshot, so they can be
+// served while the API server is unreachable at startup.
+func (s *Server) loadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var list networkingv1.IngressList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	ingresses := make([]*networkingv1.Ingress, len(list.Items))
+	for i := range list.Items {
+		ingresses[i] = &list.Items[i]
+	}
+	s.snapshot.Store(&ingresses)
+	slog.Info("Loaded ingress snapshot", "path", path, "ingresses", len(ingresses))
+	return nil
+}
+
+// saveSnapshot writes the cached ingresses to path, keeping only what
+// answering needs. The file is replaced atomically so a crash mid-write
+// can't leave a truncated snapshot behind.
+func (s *Server) saveSnapshot(path string) error {
+	cached, err := s.cachedIngresses()
+	if err != nil {
+		return err
+	}
+	list := networkingv1.IngressList{Items: make([]networkingv1.Ingress, len(cached))}
+	for i, ingress := range cached {
+		list.Items[i] = networkingv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        ingress.Name,
+				Namespace:   ingress.Namespace,
+				Annotations: ingress.Annotations,
+			},
+			Spec:   ingress.Spec,
+			Status: ingress.Status,
+		}
+	}
+	data, err := json.Marshal(&list)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// markCacheSynced records that the informer cache has synced and saves a
+// first snapshot of it.
+func (s *Server) markCacheSynced() {
+	s.cacheSynced.Store(true)
+	s.lastSync.Store(time.Now().UnixNano())
+	path := s.config().SnapshotPath
+	if path == "" {
+		return
+	}
+	if err := s.saveSnapshot(path); err != nil {
+		slog.Warn("Failed to save ingress snapshot", "path", path, "err", err)
+	}
+}
+
+// watchSnapshot keeps the snapshot up to date with the synced cache.
+func (s *Server) watchSnapshot(path string, interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		if !s.cacheSynced.Load() {
+			continue
+		}
+		if err := s.saveSnapshot(path); err != nil {
+			slog.Warn("Failed to save ingress snapshot", "path", path, "err", err)
+		}
+	}
+}
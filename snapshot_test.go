@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	networkinglisters "k8s.io/client-go/listers/networking/v1"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newUnreachableServer builds a Server whose informer cache never synced
+// and whose API server refuses every list, as when it is down at startup.
+func newUnreachableServer(t testing.TB, env map[string]string) *Server {
+	t.Helper()
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "ingresses", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewUnauthorized("API server unavailable")
+	})
+	s := newServer(testConfig(t, env), client)
+	s.ingressListers = []networkinglisters.IngressLister{networkinglisters.NewIngressLister(newIndexer[*networkingv1.Ingress](t))}
+	return s
+}
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	ingress := withStatus(newIngress("app", "app.example.com", "*.apps.example.com"), "10.0.0.2")
+	ingress.Annotations = map[string]string{ttlAnnotation: "120"}
+	saved := newTestServer(t, nil, ingress)
+	if err := saved.saveSnapshot(path); err != nil {
+		t.Fatalf("saveSnapshot: %v", err)
+	}
+
+	s := newUnreachableServer(t, nil)
+	if r := query(t, s, "app.example.com", dns.TypeA); r.Rcode != dns.RcodeNameError {
+		t.Errorf("without a snapshot: rcode = %s, want NXDOMAIN from the empty cache", dns.RcodeToString[r.Rcode])
+	}
+	if err := s.loadSnapshot(path); err != nil {
+		t.Fatalf("loadSnapshot: %v", err)
+	}
+	s.responses.flush()
+	for _, host := range []string{"app.example.com", "web.apps.example.com"} {
+		r := query(t, s, host, dns.TypeA)
+		if got := rdata(r.Answer); !slices.Equal(got, []string{"A 10.0.0.2"}) {
+			t.Errorf("%s from the snapshot: answer = %q, want [A 10.0.0.2]", host, got)
+		}
+		if len(r.Answer) == 1 && r.Answer[0].Header().Ttl != 120 {
+			t.Errorf("%s from the snapshot: TTL = %d, want the annotated 120", host, r.Answer[0].Header().Ttl)
+		}
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	dir := t.TempDir()
+	s := newUnreachableServer(t, nil)
+	if err := s.loadSnapshot(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("loading a missing snapshot: error = %v, want not exist", err)
+	}
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte(`{"items": [`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.loadSnapshot(corrupt); err == nil {
+		t.Error("loading a corrupt snapshot succeeded, want an error")
+	}
+	if s.snapshot.Load() != nil {
+		t.Error("a failed load left a snapshot behind")
+	}
+}
+
+func TestSnapshotSavedOnSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	client := fake.NewSimpleClientset(withStatus(newIngress("app", "app.example.com"), "10.0.0.2"))
+	newInformerServer(t, map[string]string{"SNAPSHOT_PATH": path}, client)
+	waitFor(t, "the snapshot to be written", func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	})
+
+	s := newUnreachableServer(t, nil)
+	if err := s.loadSnapshot(path); err != nil {
+		t.Fatalf("loadSnapshot: %v", err)
+	}
+	if got := rdata(query(t, s, "app.example.com", dns.TypeA).Answer); !slices.Equal(got, []string{"A 10.0.0.2"}) {
+		t.Errorf("answer = %q, want [A 10.0.0.2]", got)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".snapshot-*")); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
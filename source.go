@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// answerSource names the source processQuery answers a question from, as
+// reported by /explain.
+type answerSource string
+
+const (
+	sourceDenied      answerSource = "denied"
+	sourceReserved    answerSource = "reserved"
+	sourceMaintenance answerSource = "maintenance"
+	sourceStatic      answerSource = "static"
+	sourceSelf        answerSource = "self"
+	sourceIngress     answerSource = "ingress"
+	// sourceNoAddress is a matched host without an address, answered as
+	// NO_IP_BEHAVIOR says unless that is fallback.
+	sourceNoAddress answerSource = "no-address"
+	// sourceZone is a name in a ZONE that nothing matched, answered with
+	// NXDOMAIN, or NODATA for the apex.
+	sourceZone answerSource = "zone"
+	// sourceUnmatched is a name nothing matched that can't be forwarded,
+	// answered with UNMATCHED_RCODE.
+	sourceUnmatched answerSource = "unmatched"
+	sourceFallback  answerSource = "fallback"
+	// sourceError is a failure to get the ingresses, answered with
+	// SERVFAIL.
+	sourceError answerSource = "error"
+)
+
+// priorSource returns the source that answers name ahead of the ingresses,
+// and the addresses it answers with, or "" if the name is left to the
+// ingresses.
+func (s *Server) priorSource(name string) (answerSource, []string) {
+	switch {
+	case s.nameDenied(name):
+		return sourceDenied, nil
+	case reservedName(name):
+		return sourceReserved, nil
+	}
+	if ips, ok := s.config().MaintenanceHosts[dns.CanonicalName(name)]; ok {
+		return sourceMaintenance, ips
+	}
+	if ips := s.lookupStaticHost(name); ips != nil {
+		return sourceStatic, ips
+	}
+	if ips := s.lookupSelfName(name); ips != nil {
+		return sourceSelf, ips
+	}
+	return "", nil
+}
+
+// matchedSource returns the source that answers name given the outcome of
+// matching it against the ingresses.
+func (s *Server) matchedSource(name, zone string, err error) answerSource {
+	forwardable := !s.config().DisableFallback && len(s.upstreamServers(name)) > 0
+	switch {
+	case err == nil:
+		return sourceIngress
+	case errors.Is(err, errNoAddress):
+		if s.config().NoIPBehavior == "fallback" && forwardable {
+			return sourceFallback
+		}
+		return sourceNoAddress
+	case !errors.Is(err, errNoMatch):
+		return sourceError
+	case zone != "":
+		return sourceZone
+	case !forwardable:
+		return sourceUnmatched
+	}
+	return sourceFallback
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAnswerPrecedence(t *testing.T) {
+	upstream := startUpstream(t, answerWith("A 192.0.2.1"))
+	// Each name is known to its source and every one below it.
+	path := writeStaticHosts(t, "10.0.0.5 maintained.example.com static.example.com self.example.com\n")
+	env := fallbackEnv(upstream)
+	env["STATIC_HOSTS"] = path
+	env["MAINTENANCE_HOSTS"] = "maintained.example.com=10.0.0.99,blocked.example.com=10.0.0.99"
+	env["SELF_NAMES"] = "self.example.com"
+	env["POD_IP"] = "10.0.0.53"
+	env["DENY_NAME_REGEX"] = `^blocked\.`
+	s := newTestServer(t, env, withStatus(newIngress("app",
+		"maintained.example.com", "static.example.com", "self.example.com", "ingress.example.com", "blocked.example.com", "localhost"), "10.0.0.2"))
+	if err := s.loadStaticHosts(path); err != nil {
+		t.Fatalf("loadStaticHosts: %v", err)
+	}
+	tests := []struct {
+		host   string
+		source answerSource
+		rcode  int
+		answer []string
+	}{
+		{"blocked.example.com", sourceDenied, dns.RcodeNameError, nil},
+		{"localhost", sourceReserved, dns.RcodeSuccess, []string{"A 127.0.0.1"}},
+		{"maintained.example.com", sourceMaintenance, dns.RcodeSuccess, []string{"A 10.0.0.99"}},
+		{"static.example.com", sourceStatic, dns.RcodeSuccess, []string{"A 10.0.0.5"}},
+		{"self.example.com", sourceStatic, dns.RcodeSuccess, []string{"A 10.0.0.5"}},
+		{"ingress.example.com", sourceIngress, dns.RcodeSuccess, []string{"A 10.0.0.2"}},
+		{"example.org", sourceFallback, dns.RcodeSuccess, []string{"A 192.0.2.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			r := query(t, s, tt.host, dns.TypeA)
+			if got := rdata(r.Answer); r.Rcode != tt.rcode || !slices.Equal(got, tt.answer) {
+				t.Errorf("answer = %s %q, want %s %q", dns.RcodeToString[r.Rcode], got, dns.RcodeToString[tt.rcode], tt.answer)
+			}
+			if _, result := explain(t, s, url.Values{"name": {tt.host}}); result["source"] != string(tt.source) {
+				t.Errorf("/explain source = %v, want %s", result["source"], tt.source)
+			}
+		})
+	}
+}
+
+func TestExplainSources(t *testing.T) {
+	upstream := startUpstream(t, answerWith("A 192.0.2.1"))
+	tests := []struct {
+		name   string
+		env    map[string]string
+		host   string
+		source answerSource
+	}{
+		{"self", map[string]string{"SELF_NAMES": "dns.example.com", "POD_IP": "10.0.0.53"}, "dns.example.com", sourceSelf},
+		{"no address", map[string]string{"INGRESS_IP": "0.0.0.0"}, "app.example.com", sourceNoAddress},
+		{"no address, forwarded", map[string]string{"INGRESS_IP": "0.0.0.0", "NO_IP_BEHAVIOR": "fallback", "DISABLE_FALLBACK": "false", "FALLBACK_DNS": upstream}, "app.example.com", sourceFallback},
+		{"zone", map[string]string{"ZONE": "example.com"}, "missing.example.com", sourceZone},
+		{"unmatched", nil, "missing.example.com", sourceUnmatched},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.env, newIngress("app", "app.example.com"))
+			if _, result := explain(t, s, url.Values{"name": {tt.host}}); result["source"] != string(tt.source) {
+				t.Errorf("/explain source = %v, want %s", result["source"], tt.source)
+			}
+		})
+	}
+}
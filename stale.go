@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// informerHealth tracks whether an informer's watch is working. A failed
+// list or watch marks it failing until the informer syncs to a new resource
+// version, which takes a successful list or watch event.
+type informerHealth struct {
+	informer cache.SharedIndexInformer
+
+	mu            sync.Mutex
+	failing       bool
+	failedVersion string
+}
+
+// trackInformer watches the informer's list and watch errors, so STALE_AFTER
+// can tell when the cache stops following the API server. It must be called
+// before the informer is started.
+func (s *Server) trackInformer(informer cache.SharedIndexInformer) {
+	h := &informerHealth{informer: informer}
+	err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		cache.DefaultWatchErrorHandler(r, err)
+		h.fail()
+	})
+	if err != nil {
+		slog.Warn("Failed to track informer health", "err", err)
+		return
+	}
+	s.informers = append(s.informers, h)
+}
+
+func (h *informerHealth) fail() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.failing {
+		h.failing, h.failedVersion = true, h.informer.LastSyncResourceVersion()
+	}
+}
+
+// healthy reports whether the informer has synced since its last failure.
+func (h *informerHealth) healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.failing && h.informer.LastSyncResourceVersion() != h.failedVersion {
+		h.failing = false
+	}
+	return !h.failing
+}
+
+// staleness is how long ago the cache was last known to be in sync with the
+// API server, zero until it first syncs.
+func (s *Server) staleness() time.Duration {
+	last := s.lastSync.Load()
+	if last == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+// cacheStale reports whether the cache has gone longer than STALE_AFTER
+// without being confirmed in sync.
+func (s *Server) cacheStale() bool {
+	after := s.config().StaleAfter
+	return after > 0 && s.staleness() > after
+}
+
+// refuseStale reports whether ingress answers are to be refused with
+// SERVFAIL because the cache is stale and STALE_BEHAVIOR is servfail.
+func (s *Server) refuseStale() bool {
+	return s.cacheStale() && s.config().StaleBehavior == "servfail"
+}
+
+// watchStaleness confirms the cache is in sync a few times per STALE_AFTER,
+// as long as none of the informers is failing to list or watch. A cache not
+// confirmed in time is taken to be stale.
+func (s *Server) watchStaleness(after time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(after / 4)
+	defer ticker.Stop()
+	stale := false
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		if !s.cacheSynced.Load() {
+			continue
+		}
+		if s.informersHealthy() {
+			s.lastSync.Store(time.Now().UnixNano())
+		}
+		if s.cacheStale() != stale {
+			stale = !stale
+			if stale {
+				slog.Warn("Ingress cache is stale", "since", s.staleness(), "behavior", s.config().StaleBehavior)
+			} else {
+				slog.Info("Ingress cache back in sync")
+			}
+		}
+	}
+}
+
+// informersHealthy reports whether every informer has synced since its last
+// list or watch failure.
+func (s *Server) informersHealthy() bool {
+	for _, h := range s.informers {
+		if !h.healthy() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/client-go/tools/cache"
+)
+
+// fakeInformer is an informer whose last synced resource version is set by
+// the test.
+type fakeInformer struct {
+	cache.SharedIndexInformer
+	mu      sync.Mutex
+	version string
+}
+
+func (i *fakeInformer) LastSyncResourceVersion() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.version
+}
+
+func (i *fakeInformer) setVersion(version string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.version = version
+}
+
+func TestInformerHealth(t *testing.T) {
+	informer := &fakeInformer{version: "1"}
+	h := &informerHealth{informer: informer}
+	s := newTestServer(t, nil)
+	s.informers = []*informerHealth{h}
+	if !s.informersHealthy() {
+		t.Fatal("informer unhealthy before any failure")
+	}
+
+	h.fail()
+	if s.informersHealthy() {
+		t.Error("informer healthy after a failed watch")
+	}
+	informer.setVersion("1")
+	h.fail() // A retry failing again keeps the version of the first failure.
+	if s.informersHealthy() {
+		t.Error("informer healthy without syncing since the failure")
+	}
+	informer.setVersion("2")
+	if !s.informersHealthy() {
+		t.Error("informer unhealthy after syncing to a new version")
+	}
+}
+
+func TestStaleCache(t *testing.T) {
+	ingress := newIngress("app", "app.example.com")
+	tests := []struct {
+		name     string
+		behavior string
+		age      time.Duration
+		rcode    int
+		ready    int
+	}{
+		{"fresh", "servfail", 10 * time.Second, dns.RcodeSuccess, http.StatusOK},
+		{"stale, servfail", "servfail", 2 * time.Minute, dns.RcodeServerFailure, http.StatusOK},
+		{"stale, notready", "notready", 2 * time.Minute, dns.RcodeSuccess, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]string{"STALE_AFTER": "1m", "STALE_BEHAVIOR": tt.behavior}, ingress)
+			s.lastSync.Store(time.Now().Add(-tt.age).UnixNano())
+			if r := query(t, s, "app.example.com", dns.TypeA); r.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			rec := httptest.NewRecorder()
+			s.handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.ready {
+				t.Errorf("/readyz = %d, want %d", rec.Code, tt.ready)
+			}
+			if got := s.staleness(); got < tt.age || got > tt.age+time.Minute {
+				t.Errorf("staleness = %s, want about %s", got, tt.age)
+			}
+		})
+	}
+}
+
+func TestWatchStaleness(t *testing.T) {
+	informer := &fakeInformer{version: "1"}
+	h := &informerHealth{informer: informer}
+	s := newTestServer(t, map[string]string{"STALE_AFTER": "200ms"})
+	s.informers = []*informerHealth{h}
+	if s.staleness() != 0 {
+		t.Errorf("staleness before the first sync = %s, want 0", s.staleness())
+	}
+	s.lastSync.Store(time.Now().UnixNano())
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go s.watchStaleness(200*time.Millisecond, stopCh)
+
+	// A healthy informer keeps the cache confirmed in sync.
+	time.Sleep(400 * time.Millisecond)
+	if s.cacheStale() {
+		t.Fatalf("cache stale after %s with a healthy informer", s.staleness())
+	}
+	h.fail()
+	waitFor(t, "the cache to go stale", s.cacheStale)
+	informer.setVersion("2")
+	waitFor(t, "the cache to be back in sync", func() bool { return !s.cacheStale() })
+}
+
+func TestStaleCacheSkipsCachedAnswers(t *testing.T) {
+	ingress := newIngress("app", "app.example.com")
+	env := fallbackEnv(startUpstream(t, answerWith("A 192.0.2.1")))
+	env["STALE_AFTER"], env["STALE_BEHAVIOR"] = "1m", "servfail"
+	s := newTestServer(t, env, ingress)
+	s.lastSync.Store(time.Now().UnixNano())
+	if r := query(t, s, "app.example.com", dns.TypeA); r.Rcode != dns.RcodeSuccess || !slices.Equal(rdata(r.Answer), []string{"A 10.0.0.1"}) {
+		t.Fatalf("fresh: rcode %s, answer %v", dns.RcodeToString[r.Rcode], rdata(r.Answer))
+	}
+	if r := query(t, s, "upstream.test", dns.TypeA); r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("fresh upstream: rcode %s", dns.RcodeToString[r.Rcode])
+	}
+
+	s.lastSync.Store(time.Now().Add(-time.Hour).UnixNano())
+	if r := query(t, s, "app.example.com", dns.TypeA); r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("stale: rcode %s, answer %v, want SERVFAIL", dns.RcodeToString[r.Rcode], rdata(r.Answer))
+	}
+	if r := query(t, s, "upstream.test", dns.TypeA); r.Rcode != dns.RcodeSuccess || !slices.Equal(rdata(r.Answer), []string{"A 192.0.2.1"}) {
+		t.Errorf("stale upstream: rcode %s, answer %v, want the cached forwarded answer", dns.RcodeToString[r.Rcode], rdata(r.Answer))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// parseStaticHosts reads a hosts(5) style file: an address followed by one
+// or more names per line, with # starting a comment. A name listed on
+// several lines gets all of their addresses.
+func parseStaticHosts(r io.Reader) (map[string][]string, error) {
+	hosts := make(map[string][]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected an address followed by names", line)
+		}
+		for _, name := range fields[1:] {
+			key := dns.CanonicalName(name)
+			hosts[key] = append(hosts[key], ip.String())
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+func (s *Server) loadStaticHosts(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hosts, err := parseStaticHosts(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	old := s.staticHosts.Swap(&hosts)
+	slog.Info("Loaded static hosts", "path", path, "names", len(hosts))
+	if old == nil || !maps.EqualFunc(*old, hosts, slices.Equal) {
+		// Cached answers hold the previous addresses.
+		s.responses.flush()
+	}
+	return nil
+}
+
+// watchStaticHosts re-reads the file whenever its modification time
+// changes. A file that fails to parse keeps the previous hosts in place.
+func (s *Server) watchStaticHosts(path string, interval time.Duration, stopCh <-chan struct{}) {
+	var lastMod time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+		if err := s.loadStaticHosts(path); err != nil {
+			slog.Warn("Failed to reload static hosts", "err", err)
+		}
+	}
+}
+
+func (s *Server) lookupStaticHost(name string) []string {
+	hosts := s.staticHosts.Load()
+	if hosts == nil {
+		return nil
+	}
+	return (*hosts)[dns.CanonicalName(name)]
+}
+
+// lookupSelfName returns POD_IP for the names in SELF_NAMES.
+func (s *Server) lookupSelfName(name string) []string {
+	if !slices.Contains(s.config().SelfNames, dns.CanonicalName(name)) {
+		return nil
+	}
+	return []string{s.config().PodIP}
+}
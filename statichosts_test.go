@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseStaticHosts(t *testing.T) {
+	hosts, err := parseStaticHosts(strings.NewReader(`
+# static overlay
+10.0.0.5   db.example.com  DB2.example.com.
+2001:db8::5 db.example.com # IPv6 too
+
+10.0.0.6 cache.example.com
+`))
+	if err != nil {
+		t.Fatalf("parseStaticHosts: %v", err)
+	}
+	want := map[string][]string{
+		"db.example.com.":    {"10.0.0.5", "2001:db8::5"},
+		"db2.example.com.":   {"10.0.0.5"},
+		"cache.example.com.": {"10.0.0.6"},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("hosts = %v, want %v", hosts, want)
+	}
+
+	for _, bad := range []string{"db.example.com 10.0.0.5\n", "10.0.0.5\n"} {
+		if _, err := parseStaticHosts(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseStaticHosts(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+// writeStaticHosts writes a static hosts file and returns its path.
+func writeStaticHosts(t testing.TB, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("writing static hosts: %v", err)
+	}
+	return path
+}
+
+func TestStaticHostsPrecedence(t *testing.T) {
+	path := writeStaticHosts(t, "10.0.0.5 app.example.com static.example.com\n")
+	s := newTestServer(t, map[string]string{"STATIC_HOSTS": path},
+		withStatus(newIngress("app", "app.example.com", "other.example.com"), "10.0.0.2"))
+	if err := s.loadStaticHosts(path); err != nil {
+		t.Fatalf("loadStaticHosts: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		answer []string
+	}{
+		{"app.example.com", dns.TypeA, []string{"A 10.0.0.5"}},
+		{"app.example.com", dns.TypeAAAA, nil},
+		{"static.example.com", dns.TypeA, []string{"A 10.0.0.5"}},
+		{"other.example.com", dns.TypeA, []string{"A 10.0.0.2"}},
+	}
+	for _, tt := range tests {
+		r := query(t, s, tt.name, tt.qtype)
+		if r.Rcode != dns.RcodeSuccess {
+			t.Errorf("%s %s: rcode = %s, want NOERROR", tt.name, dns.Type(tt.qtype), dns.RcodeToString[r.Rcode])
+		}
+		if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+			t.Errorf("%s %s: answer = %q, want %q", tt.name, dns.Type(tt.qtype), got, tt.answer)
+		}
+	}
+}
+
+func TestStaticHostsReload(t *testing.T) {
+	path := writeStaticHosts(t, "10.0.0.5 db.example.com\n")
+	s := newTestServer(t, map[string]string{"STATIC_HOSTS": path})
+	if err := s.loadStaticHosts(path); err != nil {
+		t.Fatalf("loadStaticHosts: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		contents string
+		rcode    int
+		answer   []string
+	}{
+		{"initial", "10.0.0.5 db.example.com\n", dns.RcodeSuccess, []string{"A 10.0.0.5"}},
+		{"unchanged", "10.0.0.5 db.example.com\n", dns.RcodeSuccess, []string{"A 10.0.0.5"}},
+		{"changed address", "10.0.0.9 db.example.com\n", dns.RcodeSuccess, []string{"A 10.0.0.9"}},
+		{"removed", "10.0.0.9 other.example.com\n", dns.RcodeNameError, nil},
+	}
+	for _, tt := range tests {
+		if err := os.WriteFile(path, []byte(tt.contents), 0o644); err != nil {
+			t.Fatalf("writing static hosts: %v", err)
+		}
+		if err := s.loadStaticHosts(path); err != nil {
+			t.Fatalf("%s: loadStaticHosts: %v", tt.name, err)
+		}
+		r := query(t, s, "db.example.com", dns.TypeA)
+		if r.Rcode != tt.rcode {
+			t.Errorf("%s: rcode = %s, want %s", tt.name, dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		if got := rdata(r.Answer); !slices.Equal(got, tt.answer) {
+			t.Errorf("%s: answer = %q, want %q", tt.name, got, tt.answer)
+		}
+	}
+}
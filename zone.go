@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// soaSerial changes on every restart so secondaries notice new data.
+var soaSerial = uint32(time.Now().Unix())
+
+// zoneFor returns the most specific configured zone containing name, or an
+// empty string when the name is outside every zone.
+func (s *Server) zoneFor(name string) string {
+	zone := ""
+	for _, candidate := range s.config().Zones {
+		if dns.IsSubDomain(candidate, dns.Fqdn(name)) && len(candidate) > len(zone) {
+			zone = candidate
+		}
+	}
+	return zone
+}
+
+// newSOA synthesizes the SOA record for one of the configured zones. The
+// SOA_MNAME and SOA_RNAME defaults are ns.<zone> and hostmaster.<zone>.
+func (s *Server) newSOA(zone string) dns.RR {
+	mname, rname := s.config().SOAMname, s.config().SOARname
+	if mname == "" {
+		mname = "ns." + zone
+	}
+	if rname == "" {
+		rname = "hostmaster." + zone
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.config().DNSTTL},
+		Ns:      dns.Fqdn(mname),
+		Mbox:    dns.Fqdn(strings.Replace(rname, "@", ".", 1)),
+		Serial:  soaSerial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  s.config().DNSTTL,
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSOA(t *testing.T) {
+	s := newTestServer(t, map[string]string{"ZONE": "example.com,internal.example.com", "DNS_TTL": "60"}, newIngress("app", "app.example.com"))
+
+	r := query(t, s, "example.com", dns.TypeSOA)
+	if len(r.Answer) != 1 {
+		t.Fatalf("SOA answer = %q, want one record", rdata(r.Answer))
+	}
+	soa, ok := r.Answer[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("answer %v is not an SOA", r.Answer[0])
+	}
+	if soa.Hdr.Name != "example.com." || soa.Ns != "ns.example.com." || soa.Mbox != "hostmaster.example.com." ||
+		soa.Serial != soaSerial || soa.Minttl != 60 || soa.Hdr.Ttl != 60 {
+		t.Errorf("SOA = %v, want example.com. with ns.example.com., hostmaster.example.com. and a TTL and minimum of 60", soa)
+	}
+	if !r.Authoritative {
+		t.Error("SOA answer without AA")
+	}
+
+	tests := []struct {
+		name  string
+		rcode int
+		zone  string
+	}{
+		{"missing.example.com", dns.RcodeNameError, "example.com."},
+		{"missing.internal.example.com", dns.RcodeNameError, "internal.example.com."},
+		{"internal.example.com", dns.RcodeSuccess, "internal.example.com."},
+	}
+	for _, tt := range tests {
+		r := query(t, s, tt.name, dns.TypeA)
+		if r.Rcode != tt.rcode {
+			t.Errorf("%s: rcode = %s, want %s", tt.name, dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.rcode])
+		}
+		if len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA || r.Ns[0].Header().Name != tt.zone {
+			t.Errorf("%s: authority = %v, want the SOA of %s", tt.name, r.Ns, tt.zone)
+		}
+	}
+}
+
+func TestSOANames(t *testing.T) {
+	s := newTestServer(t, map[string]string{"ZONE": "example.com", "SOA_MNAME": "dns.example.net", "SOA_RNAME": "ops@example.net"})
+	soa := s.newSOA("example.com.").(*dns.SOA)
+	if soa.Ns != "dns.example.net." || soa.Mbox != "ops.example.net." {
+		t.Errorf("SOA names = %s %s, want dns.example.net. ops.example.net.", soa.Ns, soa.Mbox)
+	}
+}